@@ -13,9 +13,11 @@ import (
 	rpc "github.com/danos/vyatta-kdump/internal/rpc"
 	st "github.com/danos/vyatta-kdump/internal/state"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 const (
@@ -25,34 +27,120 @@ const (
 )
 
 const statusTemplate = `
-{{- $hdr_fmt := "%6.6s  %24.24s  %20.20s  %16.16s"}}
-{{- $fmt := "%6d  %24.24s  %20.20s  %16d"}}
+{{- $hdr_fmt := "%6.6s  %24.24s  %25.25s  %16.16s  %16.16s  %10.10s"}}
+{{- $fmt := "%6d  %24.24s  %25.25s  %16d  %16.16s  %10.10s"}}
 Kernel Crash Dump Status : {{.OpStatus}}{{- if .Status.NeedReboot }} (Next Boot: {{.CfgState}}), Reboot Needed{{end}}
   Reserved Memory : {{.ReservedMemoryFromStatus}} (Configured: {{.ReservedMemStr}})
   Number of Captured Kernel Crash Dumps: {{.CrashCount}}
 {{if .CrashCount}}
-{{- printf $hdr_fmt "Index" "Path" "Timestamp" "Size"}}
-{{ repeat "_" 72}}
+{{- printf $hdr_fmt "Index" "Path" "Timestamp" "Size" "Signature" "Integrity"}}
+{{ repeat "_" 109}}
 {{range .Status.CrashDumps -}}
-{{printf $fmt .Index .Path .Timestamp .Size}}
+{{printf $fmt .Index .Path .Timestamp .Size .Signature .Integrity}}
 {{end}}
+{{- range .Status.CrashDumps}}
+{{- if .Pinned}}
+Crash Dump {{.Index}} is pinned{{if .Notes}}: {{.Notes}}{{end}}
+{{- else if .Notes}}
+Crash Dump {{.Index}} notes: {{.Notes}}
+{{- end}}
+{{- end}}
+{{- range .Status.CrashDumps}}
+{{- if .Incomplete}}
+Crash Dump {{.Index}} is incomplete: {{.IncompleteReason}}
+{{end}}
+{{- end}}
+{{- range .Status.CrashDumps}}
+{{- if .KnownIssue}}
+Crash Dump {{.Index}} matches known issue {{.KnownIssue.BugID}}: {{.KnownIssue.Title}}
+{{- if .KnownIssue.Advice}}
+  {{.KnownIssue.Advice}}
+{{- end}}
+{{end}}
+{{- end}}
 {{end}}
 `
 
 func main() {
 	arg_show := flag.Bool("show", false, "Show Kernel crash dumps")
 	arg_msg := flag.Bool("message", false, "Show Crash dump messages")
+	arg_symbolize := flag.Bool("symbolize", false, "Resolve kernel addresses in Crash dump messages")
+	arg_tail := flag.Uint("tail", 0, "Show the last lines of Crash dump messages")
+	arg_level := flag.String("level", "", "Show Crash dump messages of this log level or more severe")
+	arg_match := flag.String("match", "", "Show Crash dump messages matching a regular expression")
+	arg_detail := flag.Bool("detail", false, "Show Crash dump details")
+	arg_analysis := flag.Bool("analysis", false, "Show Crash dump analysis")
+	arg_sigs := flag.Bool("signatures", false, "Show Kernel crash dumps grouped by signature")
+	arg_crash := flag.Bool("crash", false, "Run crash utility commands on a Kernel Crash Dump")
+	arg_integrity := flag.Bool("integrity", false, "Show the last verification of Kernel Crash Dumps")
+	arg_verify := flag.Bool("verify", false, "Verify Kernel Crash Dumps against their checksum manifests")
+	arg_salvage := flag.Bool("salvage", false, "Salvage the kernel log from an incomplete Kernel Crash Dump")
+	arg_report := flag.Bool("report", false, "Generate a Kernel Crash Dump report")
 	arg_del := flag.Bool("delete", false, "Delete Kernel Crash Dumps")
+	arg_secure := flag.Bool("secure", false, "Overwrite Kernel Crash Dump files before deleting them")
+	arg_cleanup := flag.Bool("cleanup", false, "Remove crash directory entries that are not Kernel Crash Dumps")
+	arg_dryrun := flag.Bool("dry-run", false, "List crash directory entries that would be removed")
+	arg_force := flag.Bool("force", false, "Also delete pinned Kernel Crash Dumps")
+	arg_pin := flag.Bool("pin", false, "Protect a Kernel Crash Dump from deletion")
+	arg_unpin := flag.Bool("unpin", false, "Remove the protection of a Kernel Crash Dump")
+	arg_notes := flag.String("notes", "", "Attach notes to a Kernel Crash Dump")
+	arg_export := flag.String("export", "", "Export Kernel Crash Dumps to an archive")
+	arg_compression := flag.String("compression", "", "Compression of the exported archive")
+	arg_upload := flag.String("upload", "", "Upload Kernel Crash Dumps to an upload destination")
+	arg_bundle := flag.Bool("bundle", false, "Upload Kernel Crash Dumps as a single archive")
+	arg_dests := flag.Bool("destinations", false, "List upload destinations")
+	arg_import := flag.String("import", "", "Import a Kernel Crash Dump file")
+	arg_desc := flag.String("description", "", "Where the imported Kernel Crash Dump came from")
+	arg_queue := flag.Bool("upload-queue", false, "Show the upload queue")
+	arg_cancel := flag.String("cancel-upload", "", "Cancel an upload of the upload queue")
+	arg_retry := flag.String("retry-upload", "", "Retry an upload of the upload queue now")
+	arg_queue_ids := flag.Bool("queue-ids", false, "List upload queue ids")
 	arg_allowed := flag.Bool("allowed", false, "Delete Kernel Crash Dumps")
 
 	flag.Parse()
-	if flag.NFlag() != 1 {
+	nflags := flag.NFlag()
+	if *arg_symbolize {
+		nflags--
+	}
+	notes := false
+	export := false
+	upload := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "tail", "level", "match", "compression", "description":
+			nflags--
+		case "notes":
+			notes = true
+		case "export":
+			export = true
+		case "upload":
+			upload = true
+		}
+	})
+	if *arg_secure {
+		nflags--
+	}
+	if *arg_dryrun {
+		nflags--
+	}
+	if *arg_force {
+		nflags--
+	}
+	if *arg_bundle {
+		nflags--
+	}
+	if nflags != 1 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
 	req_list := make([]int, 0)
+	id_list := make([]string, 0)
 	for _, arg := range flag.Args() {
+		if isDumpID(arg) {
+			id_list = append(id_list, arg)
+			continue
+		}
 		n, err := strconv.ParseInt(arg, 0, 0)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Ignoring Inavlid Kernel Crash Dump Index %s", arg)
@@ -64,9 +152,57 @@ func main() {
 	if *arg_show {
 		err = showKDump()
 	} else if *arg_msg {
-		err = showDMsg(req_list)
+		in := &rpc.DMesgInput{
+			Index:     indexInput(req_list),
+			ID:        id_list,
+			Symbolize: *arg_symbolize,
+			Tail:      uint32(*arg_tail),
+			Level:     *arg_level,
+			Match:     *arg_match,
+		}
+		err = showDMsg(in)
+	} else if *arg_detail {
+		err = showDetail(req_list, id_list)
+	} else if *arg_sigs {
+		err = showSignatures()
+	} else if *arg_crash {
+		err = runCrashCommands(req_list, id_list)
+	} else if *arg_analysis {
+		err = showAnalysis(req_list, id_list)
+	} else if *arg_integrity {
+		err = showIntegrity(req_list, id_list)
+	} else if *arg_verify {
+		err = verifyKDump(req_list, id_list)
+	} else if *arg_salvage {
+		err = salvageKDump(req_list, id_list)
+	} else if *arg_report {
+		err = generateReport(req_list, id_list)
 	} else if *arg_del {
-		err = delKDump(req_list)
+		err = delKDump(req_list, id_list, *arg_secure, *arg_force)
+	} else if *arg_pin {
+		err = dumpRPC("pin-crash-dump", req_list, id_list, nil)
+	} else if *arg_unpin {
+		err = dumpRPC("unpin-crash-dump", req_list, id_list, nil)
+	} else if notes {
+		err = dumpRPC("set-crash-dump-notes", req_list, id_list, arg_notes)
+	} else if export {
+		err = exportKDump(req_list, id_list, *arg_export, *arg_compression)
+	} else if upload {
+		err = uploadKDump(req_list, id_list, *arg_upload, *arg_bundle, *arg_compression)
+	} else if *arg_dests {
+		err = destinations()
+	} else if *arg_import != "" {
+		err = importKDump(*arg_import, *arg_desc)
+	} else if *arg_queue {
+		err = showUploadQueue()
+	} else if *arg_cancel != "" {
+		err = queueRPC("cancel-queued-upload", *arg_cancel)
+	} else if *arg_retry != "" {
+		err = queueRPC("retry-queued-upload", *arg_retry)
+	} else if *arg_queue_ids {
+		err = queueIDs()
+	} else if *arg_cleanup {
+		err = cleanupKDump(*arg_dryrun)
 	} else if *arg_allowed {
 		err = allowed()
 	}
@@ -100,15 +236,99 @@ func showKDump() error {
 	return nil
 }
 
-func showDMsg(index []int) error {
+const signaturesTemplate = `
+{{- $hdr_fmt := "%16.16s  %5.5s  %25.25s  %25.25s  %s"}}
+{{- $fmt := "%16.16s  %5d  %25.25s  %25.25s  %s"}}
+{{- printf $hdr_fmt "Signature" "Count" "First Seen" "Last Seen" "Reason"}}
+{{ repeat "_" 110}}
+{{range . -}}
+{{printf $fmt .Signature .Count .FirstSeen .LastSeen .Reason}}
+{{end}}
+`
+
+// Crash dumps with the same signature
+type signatureGroup struct {
+	Signature string
+	Count     int
+	FirstSeen string
+	LastSeen  string
+	Reason    string
+}
+
+func groupBySignature(dumps []st.CrashDumpData) []*signatureGroup {
+	groups := make([]*signatureGroup, 0)
+	bysig := make(map[string]*signatureGroup)
+	// Crash dumps are in reverse chronological order
+	for _, cd := range dumps {
+		sig := cd.Signature
+		if sig == "" {
+			sig = "unknown"
+		}
+		g, ok := bysig[sig]
+		if !ok {
+			g = &signatureGroup{Signature: sig, LastSeen: cd.Timestamp}
+			if cd.Analysis != nil {
+				g.Reason = cd.Analysis.OopsType
+				if g.Reason == "" {
+					g.Reason = cd.Analysis.PanicMessage
+				}
+			}
+			bysig[sig] = g
+			groups = append(groups, g)
+		}
+		g.Count++
+		g.FirstSeen = cd.Timestamp
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Count > groups[j].Count
+	})
+	return groups
+}
+
+func showSignatures() error {
+	kd, err := getKDumpFullTree()
+	const cmd = "Show kernel crash dump signatures"
+
+	if err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	if kd == nil || kd.Status == nil {
+		return fmt.Errorf("%s:Status unavailable.", cmd)
+	}
+	if kd.CrashCount() == 0 {
+		fmt.Println("No kernel crash dumps")
+		return nil
+	}
+	t := template.New("Signatures")
+	t.Funcs(template.FuncMap{"repeat": strings.Repeat})
+	tmpl := template.Must(t.Parse(signaturesTemplate))
+	if err := tmpl.Execute(os.Stdout, groupBySignature(kd.Status.CrashDumps)); err != nil {
+		return fmt.Errorf("%s:Output template failed:%s", cmd, err)
+	}
+	return nil
+}
+
+func showDMsg(in *rpc.DMesgInput) error {
 	const cmd = "Show Kernel crash dump message"
 	res := &rpc.CrashDMesgOut{}
-	if err := callKDumpRPC("get-crash-dmesg", index, res); err != nil {
+	if err := callKDumpRPC("get-crash-dmesg", in, res); err != nil {
 		return fmt.Errorf("%s:%s", cmd, err)
 	}
 	for _, ci := range res.CrashInfo {
 		if ci.FileName != "" {
 			fmt.Printf("Kernel dmesg for Crash Dump %d:%s\n", ci.Index, ci.FileName)
+			switch ci.DMesgSource {
+			case "vmcore":
+				fmt.Println("(dmesg file missing or truncated, extracted from the crash dump)")
+			case "encrypted":
+				fmt.Println("(crash dump is encrypted, dmesg is not available in plaintext)")
+			}
+			if ci.TotalLines != 0 {
+				fmt.Printf("(%d of %d lines match)\n", ci.MatchedLines, ci.TotalLines)
+			}
+			if ci.UnknownLevelLines != 0 {
+				fmt.Printf("(%d lines of unknown level left out)\n", ci.UnknownLevelLines)
+			}
 			fmt.Println(ci.DMesg)
 			fmt.Printf("\n\n")
 		} else {
@@ -118,14 +338,519 @@ func showDMsg(index []int) error {
 	return nil
 }
 
-func delKDump(index []int) error {
+const detailTemplate = `
+{{- define "opt"}}{{if .}}{{.}}{{else}}unknown{{end}}{{end -}}
+Kernel Crash Dump {{.Index}}: {{.FileName}}
+  ID             : {{.ID}}
+  Timestamp      : {{.Timestamp}}
+  Format         : {{template "opt" .Format}}
+  Dump Level     : {{if .DumpLevel}}{{.DumpLevel}}{{else}}unknown{{end}}
+  Compression    : {{template "opt" .Compression}}
+  Kernel Release : {{template "opt" .KernelRelease}}
+  Build ID       : {{template "opt" .BuildID}}
+  Crash Time     : {{template "opt" .CrashTime}}
+  Panic Message  : {{template "opt" .PanicMessage}}
+  Signature      : {{template "opt" .Signature}}
+  Encrypted      : {{if .Encrypted}}yes{{else}}no{{end}}
+  Incomplete     : {{if .IncompleteReason}}{{.IncompleteReason}}{{else}}no{{end}}
+  Integrity      : {{template "opt" .Integrity}}{{if .VerifiedTime}} (verified {{.VerifiedTime}}){{end}}
+  Pinned         : {{if .Pinned}}yes{{else}}no{{end}}
+{{- if .Notes}}
+  Notes          : {{.Notes}}
+{{- end}}
+{{- if .ImportedFrom}}
+  Imported From  : {{.ImportedFrom}}{{if .ImportDesc}} ({{.ImportDesc}}){{end}} at {{.ImportTime}}
+{{- end}}
+  Files:
+{{- range .Files}}
+    {{printf "%-32s %14d" .Name .Size}}
+{{- end}}
+{{- if .Checksums}}
+  Checksums:
+{{- range .Checksums}}
+    {{.SHA256}}  {{.File}}
+{{- end}}
+{{- end}}
+
+`
+
+func showDetail(index []int, ids []string) error {
+	const cmd = "Show Kernel crash dump details"
+	res := &rpc.CrashInfoOut{}
+	in := &rpc.CrashInfoInput{Index: indexInput(index), ID: ids}
+	if err := callKDumpRPC("get-crash-info", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	tmpl := template.Must(template.New("Detail").Parse(detailTemplate))
+	for _, ci := range res.CrashDumps {
+		if ci.FileName == "" {
+			fmt.Fprintf(os.Stderr, "%s:Ignoring Invalid index %d\n", cmd, ci.Index)
+			continue
+		}
+		if err := tmpl.Execute(os.Stdout, ci); err != nil {
+			return fmt.Errorf("%s:Output template failed:%s", cmd, err)
+		}
+	}
+	return nil
+}
+
+const analysisTemplate = `
+{{- define "opt"}}{{if .}}{{.}}{{else}}unknown{{end}}{{end -}}
+Kernel Crash Dump {{.Index}}: {{.FileName}}
+  Panic Message : {{template "opt" .Analysis.PanicMessage}}
+  Oops Type     : {{template "opt" .Analysis.OopsType}}
+  Task          : {{template "opt" .Analysis.Task}}{{if .Analysis.PID}} (PID {{.Analysis.PID}}){{end}}
+  CPU           : {{if .Analysis.CPU}}{{.Analysis.CPU}}{{else}}unknown{{end}}
+  IP            : {{template "opt" .Analysis.InstructionPointer}}
+  Tainted       : {{if .Analysis.Tainted}}{{.Analysis.Tainted}} ({{join .Analysis.TaintFlags ", "}}){{else}}no{{end}}
+{{- if .Analysis.CallTrace}}
+  Call Trace:
+{{- range .Analysis.CallTrace}}
+    {{.}}
+{{- end}}
+{{- end}}
+{{- if .Analysis.HardwareErrors}}
+  Possible Hardware Errors:
+{{- range .Analysis.HardwareErrors}}
+    {{.}}
+{{- end}}
+{{- end}}
+
+`
+
+func showAnalysis(index []int, ids []string) error {
+	const cmd = "Show Kernel crash dump analysis"
+	res := &rpc.CrashAnalysisOut{}
+	in := &rpc.RPCInput{Index: indexInput(index), ID: ids}
+	if err := callKDumpRPC("get-crash-analysis", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	t := template.New("Analysis")
+	t.Funcs(template.FuncMap{"join": strings.Join})
+	tmpl := template.Must(t.Parse(analysisTemplate))
+	for _, ca := range res.CrashAnalysis {
+		if ca.FileName == "" || ca.Analysis == nil {
+			fmt.Fprintf(os.Stderr, "%s:Ignoring Invalid index %d\n", cmd, ca.Index)
+			continue
+		}
+		if err := tmpl.Execute(os.Stdout, ca); err != nil {
+			return fmt.Errorf("%s:Output template failed:%s", cmd, err)
+		}
+	}
+	return nil
+}
+
+func runCrashCommands(index []int, ids []string) error {
+	const cmd = "Run crash utility commands"
+	n, id, ok := singleDump(index, ids)
+	if !ok {
+		return fmt.Errorf("%s:A single crash dump index or id is required", cmd)
+	}
+	res := &rpc.CrashToolOut{}
+	in := &rpc.CrashToolInput{Index: n, ID: id}
+	if err := callKDumpRPC("run-crash-commands", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	fmt.Printf("Crash dump: %s\nvmlinux: %s\nTime: %s\n\n", res.FileName, res.Vmlinux, res.Time)
+	for _, o := range res.Outputs {
+		fmt.Printf("crash> %s\n%s\n\n", o.Command, o.Output)
+	}
+	return nil
+}
+
+const verifyTemplate = `
+{{- range .CrashDumps}}
+{{- if .FileName}}
+Crash Dump {{.Index}} ({{.FileName}}): {{if .Error}}{{.Error}}{{else}}{{.Integrity}}{{end}}
+{{- range .Files}}
+  {{printf "%-24s %s" .Name .Status}}
+{{- if eq .Status "mismatch"}}
+    expected {{.Expected}}
+    actual   {{.Actual}}
+{{- end}}
+{{- end}}
+{{- else}}
+Crash Dump {{.Index}}: not found
+{{- end}}
+{{end}}`
+
+const integrityTemplate = `
+{{- range .}}
+Crash Dump {{.Index}} ({{.ID}}): {{if .Integrity}}{{.Integrity}}{{else}}unknown{{end}}
+{{- if .VerifiedTime}} (verified {{.VerifiedTime}}){{end}}
+{{- end}}
+
+Use "generate kernel-crash-dump verify" to verify the crash dump files again.
+`
+
+// Show the result of the last verification of crash dumps, without
+// hashing the crash dump files again
+func showIntegrity(index []int, ids []string) error {
+	const cmd = "Show kernel crash dump integrity"
+	kd, err := getKDumpFullTree()
+	if err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	if kd == nil || kd.Status == nil {
+		return fmt.Errorf("%s:Status unavailable.", cmd)
+	}
+	ndumps := len(kd.Status.CrashDumps)
+	selected := func(cd st.CrashDumpData) bool {
+		if len(index) == 0 && len(ids) == 0 {
+			return true
+		}
+		for _, n := range index {
+			if n < 0 {
+				n += ndumps
+			}
+			if int(cd.Index) == n {
+				return true
+			}
+		}
+		for _, id := range ids {
+			if cd.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	crashdumps := make([]st.CrashDumpData, 0, len(kd.Status.CrashDumps))
+	for _, cd := range kd.Status.CrashDumps {
+		if selected(cd) {
+			crashdumps = append(crashdumps, cd)
+		}
+	}
+	if len(crashdumps) == 0 && len(index)+len(ids) != 0 {
+		return fmt.Errorf("%s:No such kernel crash dump", cmd)
+	}
+	tmpl := template.Must(template.New("Integrity").Parse(integrityTemplate))
+	if err := tmpl.Execute(os.Stdout, crashdumps); err != nil {
+		return fmt.Errorf("%s:Output template failed:%s", cmd, err)
+	}
+	return nil
+}
+
+func verifyKDump(index []int, ids []string) error {
+	const cmd = "Verify kernel crash dumps"
+	res := &rpc.VerifyOut{}
+	in := &rpc.RPCInput{Index: indexInput(index), ID: ids}
+	if err := callKDumpRPC("verify-crash-dumps", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	tmpl := template.Must(template.New("Verify").Parse(verifyTemplate))
+	if err := tmpl.Execute(os.Stdout, res); err != nil {
+		return fmt.Errorf("%s:Output template failed:%s", cmd, err)
+	}
+	return nil
+}
+
+func salvageKDump(index []int, ids []string) error {
+	const cmd = "Salvage crash dump"
+	n, id, ok := singleDump(index, ids)
+	if !ok {
+		return fmt.Errorf("%s:A single crash dump index or id is required", cmd)
+	}
+	res := &rpc.SalvageOut{}
+	in := &rpc.SalvageInput{Index: n, ID: id}
+	if err := callKDumpRPC("salvage-crash-dump", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	fmt.Printf("Crash dump: %s\n", res.FileName)
+	if res.Incomplete != "" {
+		fmt.Printf("Incomplete: %s\n", res.Incomplete)
+	}
+	if res.VMCoreInfo {
+		fmt.Println("VMCOREINFO: recovered")
+	} else {
+		fmt.Printf("VMCOREINFO: not recovered: %s\n", res.VMCoreInfoError)
+	}
+	if res.DMesgLines != 0 {
+		fmt.Printf("Kernel log: %d lines recovered\n", res.DMesgLines)
+	} else {
+		fmt.Printf("Kernel log: not recovered: %s\n", res.DMesgError)
+	}
+	return nil
+}
+
+func importKDump(path, description string) error {
+	const cmd = "Import crash dump"
+	res := &rpc.ImportOut{}
+	in := &rpc.ImportInput{Path: path, Description: description}
+	fmt.Printf("Importing %s, this may take several minutes\n", path)
+	if err := callKDumpRPC("import-crash-dump", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	fmt.Printf("Crash dump %d: %s\n", res.Index, res.FileName)
+	fmt.Printf("Format: %s\n", res.Format)
+	if res.KernelRelease != "" {
+		fmt.Printf("Kernel release: %s\n", res.KernelRelease)
+	}
+	if res.Incomplete != "" {
+		fmt.Printf("Incomplete: %s\n", res.Incomplete)
+	}
+	if res.DMesgLines != 0 {
+		fmt.Printf("Kernel log: %d lines extracted\n", res.DMesgLines)
+	} else {
+		fmt.Printf("Kernel log: not extracted: %s\n", res.DMesgError)
+	}
+	return nil
+}
+
+func generateReport(index []int, ids []string) error {
+	const cmd = "Generate crash report"
+	n, id, ok := singleDump(index, ids)
+	if !ok {
+		return fmt.Errorf("%s:A single crash dump index or id is required", cmd)
+	}
+	res := &rpc.CrashReportOut{}
+	in := &rpc.CrashReportInput{Index: n, ID: id}
+	if err := callKDumpRPC("generate-crash-report", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	fmt.Printf("Crash report for %s saved to:\n  %s\n  %s\n  %s\n",
+		res.FileName, res.JSONFile, res.MarkdownFile, res.HTMLFile)
+	return nil
+}
+
+func delKDump(index []int, ids []string, secure, force bool) error {
 	var res struct{}
-	if err := callKDumpRPC("delete-crash-dumps", index, &res); err != nil {
+	in := &rpc.DeleteInput{Index: indexInput(index), ID: ids, Secure: secure, Force: force}
+	if err := callKDumpRPC("delete-crash-dumps", in, &res); err != nil {
 		return fmt.Errorf("delete kernel-crash-dump error:%s", err)
 	}
+	return showSecureDeleteProgress()
+}
+
+// Secure deletion continues in the background. Show its progress until
+// all crash dumps are wiped.
+func showSecureDeleteProgress() error {
+	for {
+		kd, err := getKDumpFullTree()
+		if err != nil {
+			return err
+		}
+		if kd == nil || kd.Status == nil || len(kd.Status.SecureDeletes) == 0 {
+			return nil
+		}
+		for _, w := range kd.Status.SecureDeletes {
+			fmt.Printf("Wiping crash dump %s: %3d%% (%d of %d MB)\n", w.Name, w.Percent,
+				w.Wiped/MB, w.Total/MB)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func exportKDump(index []int, ids []string, dest, compression string) error {
+	const cmd = "Export crash dumps"
+	res := &rpc.ExportOut{}
+	in := &rpc.ExportInput{
+		Index:       indexInput(index),
+		ID:          ids,
+		Destination: dest,
+		Compression: compression,
+	}
+	if err := callKDumpRPC("export-crash-dumps", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	fmt.Printf("Exporting %d MB of crash dumps to %s\n", res.TotalBytes/MB, res.Archive)
+	return showExportProgress(res.Archive)
+}
+
+// The export continues in the background. Show its progress until the
+// archive is written.
+func showExportProgress(archive string) error {
+	for {
+		kd, err := getKDumpFullTree()
+		if err != nil {
+			return err
+		}
+		if kd == nil || kd.Status == nil {
+			return nil
+		}
+		var e *st.Export
+		for i := range kd.Status.Exports {
+			if kd.Status.Exports[i].Archive == archive {
+				e = &kd.Status.Exports[i]
+			}
+		}
+		if e == nil {
+			return nil
+		}
+		switch e.Status {
+		case "done":
+			fmt.Printf("Crash dumps exported to %s\n", archive)
+			return nil
+		case "failed":
+			return fmt.Errorf("Export crash dumps:%s", e.Error)
+		}
+		fmt.Printf("Exporting crash dumps: %3d%% (%d of %d MB)\n", e.Percent,
+			e.Written/MB, e.Total/MB)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func uploadKDump(index []int, ids []string, dest string, bundle bool, compression string) error {
+	const cmd = "Upload crash dumps"
+	res := &rpc.UploadOut{}
+	in := &rpc.UploadInput{
+		Index:       indexInput(index),
+		ID:          ids,
+		Destination: dest,
+		Bundle:      bundle,
+		Compression: compression,
+	}
+	if err := callKDumpRPC("upload-crash-dumps", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	fmt.Printf("Uploading crash dumps to %s\n", dest)
+	return showUploadProgress(res.UploadID)
+}
+
+// The upload continues in the background. Show the files as they are
+// uploaded until the upload is finished.
+func showUploadProgress(id string) error {
+	shown := make(map[string]bool)
+	for {
+		kd, err := getKDumpFullTree()
+		if err != nil {
+			return err
+		}
+		if kd == nil || kd.Status == nil {
+			return nil
+		}
+		var u *st.Upload
+		for i := range kd.Status.Uploads {
+			if kd.Status.Uploads[i].ID == id {
+				u = &kd.Status.Uploads[i]
+			}
+		}
+		if u == nil {
+			return nil
+		}
+		for _, f := range u.Files {
+			if shown[f.Remote] || (f.Status != "done" && f.Status != "failed") {
+				continue
+			}
+			shown[f.Remote] = true
+			switch {
+			case f.Status == "failed":
+				fmt.Printf("  %-40s failed: %s\n", f.Remote, f.Error)
+			case f.Verified:
+				fmt.Printf("  %-40s %8d KB  verified\n", f.Remote, (f.Size+1023)/1024)
+			default:
+				fmt.Printf("  %-40s %8d KB  not verified\n", f.Remote, (f.Size+1023)/1024)
+			}
+		}
+		switch u.Status {
+		case "done":
+			fmt.Printf("Crash dumps uploaded to %s\n", u.Destination)
+			return nil
+		case "failed":
+			return fmt.Errorf("Upload crash dumps:%s", u.Error)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func destinations() error {
+	kd, err := getKDumpFullTree()
+	if err != nil || kd == nil || kd.Upload == nil {
+		return err
+	}
+	for _, d := range kd.Upload.Destinations {
+		fmt.Printf("%s ", d.Name)
+	}
+	return nil
+}
+
+func showUploadQueue() error {
+	kd, err := getKDumpFullTree()
+	if err != nil || kd == nil || kd.Status == nil {
+		return err
+	}
+	if len(kd.Status.UploadQueue) == 0 {
+		fmt.Println("No queued uploads")
+		return nil
+	}
+	const fmtStr = "%-30s  %-12s  %-16s  %-10s  %8s  %s\n"
+	fmt.Printf(fmtStr, "Id", "Crash Dump", "Content", "Status", "Attempts", "Next Attempt")
+	for _, q := range kd.Status.UploadQueue {
+		fmt.Printf(fmtStr, q.ID, q.CrashDump, q.Content, q.Status,
+			strconv.FormatUint(uint64(q.Attempts), 10), q.NextAttempt)
+		if q.Error != "" {
+			fmt.Printf("  %s\n", q.Error)
+		}
+	}
+	return nil
+}
+
+func queueRPC(name, id string) error {
+	in := &rpc.QueueItemInput{ID: id}
+	if err := callKDumpRPC(name, in, &struct{}{}); err != nil {
+		return fmt.Errorf("%s:%s", name, err)
+	}
 	return nil
 }
 
+func queueIDs() error {
+	kd, err := getKDumpFullTree()
+	if err != nil || kd == nil || kd.Status == nil {
+		return err
+	}
+	for _, q := range kd.Status.UploadQueue {
+		fmt.Printf("%s ", q.ID)
+	}
+	return nil
+}
+
+func cleanupKDump(dryrun bool) error {
+	const cmd = "Clean up crash directory"
+	res := &rpc.CleanupOut{}
+	in := &rpc.CleanupInput{DryRun: dryrun}
+	if err := callKDumpRPC("cleanup-crash-directory", in, res); err != nil {
+		return fmt.Errorf("%s:%s", cmd, err)
+	}
+	if len(res.Entries) == 0 && res.Error == "" {
+		fmt.Println("No orphaned entries in the crash directory")
+		return nil
+	}
+	kept := 0
+	for _, e := range res.Entries {
+		fmt.Printf("%-40s %8d KB  %s\n", e.Path, (e.Size+1023)/1024, e.Reason)
+		if e.Kept {
+			kept++
+		}
+	}
+	removed := len(res.Entries) - kept
+	if dryrun {
+		fmt.Printf("%d entries, %d KB would be removed\n", removed, (res.TotalBytes+1023)/1024)
+	} else {
+		fmt.Printf("%d entries, %d KB removed\n", removed, (res.TotalBytes+1023)/1024)
+	}
+	if kept != 0 {
+		fmt.Printf("%d entries with crash details kept, remove them with 'delete' if not needed\n", kept)
+	}
+	if res.Error != "" {
+		return fmt.Errorf("%s:%s", cmd, res.Error)
+	}
+	return nil
+}
+
+// Call an RPC acting on a single crash dump, given by index or id
+func dumpRPC(name string, index []int, ids []string, notes *string) error {
+	n, id, ok := singleDump(index, ids)
+	if !ok {
+		return fmt.Errorf("%s:A single crash dump index or id is required", name)
+	}
+	var res struct{}
+	in := &rpc.NotesInput{Index: n, ID: id}
+	if notes == nil {
+		return callKDumpRPC(name, &rpc.DumpInput{Index: in.Index, ID: in.ID}, &res)
+	}
+	in.Notes = *notes
+	return callKDumpRPC(name, in, &res)
+}
+
 func allowed() error {
 	kd, err := getKDumpFullTree()
 	if err != nil {
@@ -142,21 +867,56 @@ func allowed() error {
 	default:
 		fmt.Printf("0..%d\n", n)
 	}
+	for _, cd := range kd.Status.CrashDumps {
+		if cd.ID != "" {
+			fmt.Printf("%s\n", cd.ID)
+		}
+	}
 	return nil
 }
 
-func callKDumpRPC(name string, dump_index []int, data interface{}) error {
+// Crash dump ids are the names of the crash directories, YYYYMMDDhhmm
+func isDumpID(arg string) bool {
+	if len(arg) != 12 {
+		return false
+	}
+	for _, c := range arg {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Select a single crash dump by index or by id. The crash dump is found
+// by the RPC, so an id still refers to the same crash dump if others are
+// saved or deleted meanwhile.
+func singleDump(index []int, ids []string) (*int32, string, bool) {
+	if len(index)+len(ids) != 1 {
+		return nil, "", false
+	}
+	if len(ids) != 0 {
+		return nil, ids[0], true
+	}
+	n := int32(index[0])
+	return &n, "", true
+}
+
+func indexInput(dump_index []int) []int32 {
+	index := make([]int32, len(dump_index))
+	for i, n := range dump_index {
+		index[i] = int32(n)
+	}
+	return index
+}
+
+func callKDumpRPC(name string, in interface{}, data interface{}) error {
 	client, err := configd.Connect()
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	in := &rpc.RPCInput{make([]int32, len(dump_index))}
-	for i, index := range dump_index {
-		in.Index[i] = int32(index)
-	}
-
 	js_input, err := rfc7951.Marshal(in)
 	if err != nil {
 		return err
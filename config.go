@@ -35,6 +35,7 @@ func ConfigNew(client *vci.Client, cache string) *Config {
 
 	cfg.readCache()
 	instance_cfg = cfg
+	kdump.EnsureManifests()
 	return cfg
 }
 
@@ -77,6 +78,11 @@ func (c *Config) applyConfig(cfg *ConfigData) error {
 	}
 
 	kd := cfg.System.KDump
+	kdump.SetSecureDelete(kd != nil && kd.SecureDelete)
+	kdump.ResumeSecureDelete()
+	kdump.SetEncryption(encryptionPolicy(kd))
+	kdump.SetUploadDestinations(uploadDestinations(kd))
+	kdump.SetAutoUpload(autoUpload(cfg))
 	if kd != nil && kd.IsEnabled() {
 		if err := kdump.Enable(kd.FilesToSave, kd.DeleteOldFiles); err != nil {
 			errs = append(errs, fmt.Errorf("Failed to enable kernel-crash-dump: %s", err))
@@ -96,6 +102,64 @@ func (c *Config) applyConfig(cfg *ConfigData) error {
 	return err
 }
 
+func encryptionPolicy(kd *cfg.KDumpData) *kdump.Encryption {
+	if kd == nil || kd.Encryption == nil {
+		return nil
+	}
+	e := kd.Encryption
+	if e.AgeRecipient == "" && e.PGPKeyFile == "" {
+		return nil
+	}
+	return &kdump.Encryption{
+		AgeRecipient:   e.AgeRecipient,
+		PGPKeyFile:     e.PGPKeyFile,
+		PlaintextDMesg: e.PlaintextDMesg,
+	}
+}
+
+func uploadDestinations(kd *cfg.KDumpData) []*kdump.UploadDest {
+	if kd == nil || kd.Upload == nil {
+		return nil
+	}
+	dests := make([]*kdump.UploadDest, len(kd.Upload.Destinations))
+	for i, d := range kd.Upload.Destinations {
+		dests[i] = &kdump.UploadDest{
+			Name:            d.Name,
+			URL:             d.URL,
+			KeyFile:         d.KeyFile,
+			KnownHostsFile:  d.KnownHostsFile,
+			BearerToken:     d.BearerToken,
+			CAFile:          d.CAFile,
+			Region:          d.Region,
+			AccessKeyID:     d.AccessKeyID,
+			SecretAccessKey: d.SecretAccessKey,
+			BlockSize:       d.BlockSize,
+		}
+	}
+	return dests
+}
+
+func autoUpload(cfg *ConfigData) *kdump.AutoUpload {
+	kd := cfg.System.KDump
+	if kd == nil || kd.Upload == nil || kd.Upload.AutoUpload == nil ||
+		kd.Upload.AutoUpload.Destination == "" {
+		return nil
+	}
+	a := kd.Upload.AutoUpload
+	p := &kdump.AutoUpload{Destination: a.Destination, Content: a.Content}
+	if p.Content == "" {
+		p.Content = kdump.UploadContentCrashDump
+	}
+	conf := *cfg
+	conf.System.KDump = kd.Redacted()
+	config, err := rfc7951.Marshal(&conf)
+	if err != nil {
+		log.Wlog.Println("Auto upload: configuration:", err)
+	}
+	p.Config = config
+	return p
+}
+
 func reserveMem(cfg *ConfigData) error {
 	kd := cfg.System.KDump
 	m := "0"
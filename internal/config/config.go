@@ -10,10 +10,43 @@ import (
 type IntOrString interface{}
 
 type KDumpData struct {
-	Enable         bool   `rfc7951:"enable,omitempty"`
-	FilesToSave    *int   `rfc7951:"files-to-save,omitempty"`
-	DeleteOldFiles bool   `rfc7951:"delete-old-files,emptyleaf"`
-	ReservedMemory IntOrString `rfc7951:"reserved-memory,omitempty"`
+	Enable         bool            `rfc7951:"enable,omitempty"`
+	FilesToSave    *int            `rfc7951:"files-to-save,omitempty"`
+	DeleteOldFiles bool            `rfc7951:"delete-old-files,emptyleaf"`
+	ReservedMemory IntOrString     `rfc7951:"reserved-memory,omitempty"`
+	CrashCommands  []string        `rfc7951:"crash-commands,omitempty"`
+	Encryption     *EncryptionData `rfc7951:"encryption,omitempty"`
+	SecureDelete   bool            `rfc7951:"secure-delete,emptyleaf"`
+	Upload         *UploadData     `rfc7951:"upload,omitempty"`
+}
+
+type EncryptionData struct {
+	AgeRecipient   string `rfc7951:"age-recipient,omitempty"`
+	PGPKeyFile     string `rfc7951:"pgp-key-file,omitempty"`
+	PlaintextDMesg bool   `rfc7951:"plaintext-dmesg,emptyleaf"`
+}
+
+type UploadData struct {
+	Destinations []UploadDestData `rfc7951:"destination,omitempty"`
+	AutoUpload   *AutoUploadData  `rfc7951:"auto-upload,omitempty"`
+}
+
+type AutoUploadData struct {
+	Destination string `rfc7951:"destination,omitempty"`
+	Content     string `rfc7951:"content,omitempty"`
+}
+
+type UploadDestData struct {
+	Name            string `rfc7951:"name"`
+	URL             string `rfc7951:"url,omitempty"`
+	KeyFile         string `rfc7951:"key-file,omitempty"`
+	KnownHostsFile  string `rfc7951:"known-hosts-file,omitempty"`
+	BearerToken     string `rfc7951:"bearer-token,omitempty"`
+	CAFile          string `rfc7951:"ca-certificate-file,omitempty"`
+	Region          string `rfc7951:"region,omitempty"`
+	AccessKeyID     string `rfc7951:"access-key-id,omitempty"`
+	SecretAccessKey string `rfc7951:"secret-access-key,omitempty"`
+	BlockSize       int    `rfc7951:"block-size,omitempty"`
 }
 
 func (cfg *KDumpData) IsEnabled() bool {
@@ -30,3 +63,26 @@ func (cfg *KDumpData) ReservedMemStr() (string, error) {
 		return "", errors.New("Not a valid type for Reserved Memory")
 	}
 }
+
+// Copy of the configuration with upload credentials removed, for including
+// in crash reports and archives
+func (cfg *KDumpData) Redacted() *KDumpData {
+	if cfg == nil || cfg.Upload == nil {
+		return cfg
+	}
+	r := *cfg
+	r.Upload = &UploadData{
+		Destinations: make([]UploadDestData, len(cfg.Upload.Destinations)),
+		AutoUpload:   cfg.Upload.AutoUpload,
+	}
+	for i, d := range cfg.Upload.Destinations {
+		if d.BearerToken != "" {
+			d.BearerToken = "********"
+		}
+		if d.SecretAccessKey != "" {
+			d.SecretAccessKey = "********"
+		}
+		r.Upload.Destinations[i] = d
+	}
+	return &r
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxHardwareHints = 16
+
+// Summary of why the system crashed, from the kernel log of a crash dump
+type CrashAnalysis struct {
+	PanicMessage  string
+	OopsType      string
+	IP            string
+	Task          string
+	PID           int // -1 if unknown
+	CPU           int // -1 if unknown
+	CallTrace     []string
+	Tainted       string
+	TaintFlags    []string
+	HardwareHints []string
+}
+
+var (
+	logPrefixRe = regexp.MustCompile(`^(<\d+>)?\[\s*\d+\.\d+\]\s?`)
+	panicRe     = regexp.MustCompile(`Kernel panic - not syncing: (.*)`)
+	cpuTaskRe   = regexp.MustCompile(`CPU: (\d+) (?:UID: \d+ )?PID: (\d+) Comm: (.+?) (?:Not tainted|Tainted: ([A-Z ]*?)) +\d`)
+	ripRe       = regexp.MustCompile(`^(?:RIP: [0-9a-f]{4}:|pc : )(.*)`)
+	traceRe     = regexp.MustCompile(`^\s*(?:Call Trace:|Call trace:)\s*$`)
+	frameRe     = regexp.MustCompile(`^\s*(?:\[<[0-9a-f]+>\]\s*)?(\? )?((?:[\w.$]+\+0x[0-9a-f]+/0x[0-9a-f]+|0x[0-9a-f]+)(?: \[[\w-]+\])?)`)
+	traceMarkRe = regexp.MustCompile(`^\s*</?(IRQ|NMI|TASK|EOI|SOFTIRQ)>\s*$`)
+
+	// Kernel oops and BUG reports in order of precedence
+	oopsRes = []*regexp.Regexp{
+		regexp.MustCompile(`(BUG: .*)`),
+		regexp.MustCompile(`(kernel BUG at .*)!`),
+		regexp.MustCompile(`(general protection fault.*)`),
+		regexp.MustCompile(`(Unable to handle kernel .*)`),
+		regexp.MustCompile(`(Internal error: .*)`),
+		regexp.MustCompile(`(Watchdog detected hard LOCKUP on cpu \d+)`),
+		regexp.MustCompile(`(Oops: .*)`),
+		regexp.MustCompile(`(sysrq: Trigger a crash|SysRq : Trigger a crash)`),
+		regexp.MustCompile(`(WARNING: .*)`),
+	}
+
+	hardwareHintRe = regexp.MustCompile(`(?i)machine check|\bmce:|\[Hardware Error\]|EDAC |` +
+		`NMI received for unknown reason|NMI: (PCI system|IOCK) error|PCIe Bus Error|` +
+		`\bAER:|Memory failure:|temperature above threshold|uncorrected error`)
+)
+
+// Kernel taint flags (kernel/panic.c)
+var taintFlags = map[byte]string{
+	'P': "proprietary-module",
+	'F': "forced-module-load",
+	'S': "out-of-spec-system",
+	'R': "forced-module-unload",
+	'M': "machine-check",
+	'B': "bad-page",
+	'U': "user-taint",
+	'D': "died-recently",
+	'A': "acpi-table-override",
+	'W': "warning",
+	'C': "staging-driver",
+	'I': "firmware-workaround",
+	'O': "out-of-tree-module",
+	'E': "unsigned-module",
+	'L': "soft-lockup",
+	'K': "live-patch",
+	'X': "auxiliary",
+	'T': "randomized-struct-layout",
+	'N': "test",
+}
+
+func decodeTaint(tainted string) []string {
+	flags := make([]string, 0)
+	for i := 0; i < len(tainted); i++ {
+		if f, ok := taintFlags[tainted[i]]; ok {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// Find the line that starts the crash report: the first oops, else the
+// panic message.
+func crashAnchor(lines []string) (int, string) {
+	for _, re := range oopsRes {
+		for i, line := range lines {
+			if m := re.FindStringSubmatch(line); m != nil {
+				return i, m[1]
+			}
+		}
+	}
+	for i, line := range lines {
+		if panicRe.MatchString(line) {
+			return i, ""
+		}
+	}
+	return 0, ""
+}
+
+// Analyse the kernel log of a crash dump
+func AnalyzeDMesg(dmesg string) *CrashAnalysis {
+	a := &CrashAnalysis{PID: -1, CPU: -1}
+	lines := strings.Split(dmesg, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(logPrefixRe.ReplaceAllString(line, ""), " \r")
+	}
+
+	for _, line := range lines {
+		if m := panicRe.FindStringSubmatch(line); m != nil {
+			a.PanicMessage = m[1]
+			break
+		}
+	}
+
+	anchor, oops := crashAnchor(lines)
+	a.OopsType = oops
+	inTrace := false
+	for _, line := range lines[anchor:] {
+		if inTrace {
+			if traceMarkRe.MatchString(line) {
+				continue
+			}
+			if m := frameRe.FindStringSubmatch(line); m != nil {
+				a.CallTrace = append(a.CallTrace, m[1]+m[2])
+				continue
+			}
+			inTrace = false
+			if len(a.CallTrace) != 0 {
+				break
+			}
+		}
+		if m := cpuTaskRe.FindStringSubmatch(line); m != nil && a.CPU < 0 {
+			a.CPU, _ = strconv.Atoi(m[1])
+			a.PID, _ = strconv.Atoi(m[2])
+			a.Task = m[3]
+			a.Tainted = strings.TrimSpace(m[4])
+			a.TaintFlags = decodeTaint(m[4])
+		}
+		if m := ripRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil && a.IP == "" {
+			a.IP = strings.TrimSpace(m[1])
+		}
+		if traceRe.MatchString(line) {
+			inTrace = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		if len(a.HardwareHints) >= maxHardwareHints {
+			break
+		}
+		if hardwareHintRe.MatchString(line) && !seen[line] {
+			seen[line] = true
+			a.HardwareHints = append(a.HardwareHints, strings.TrimSpace(line))
+		}
+	}
+	return a
+}
+
+// Size and modification time of the kernel log file of a crash dump.
+// Results derived from the kernel log are cached until it changes.
+type dmesgStamp struct {
+	size  int64
+	mtime time.Time
+}
+
+func crashDMesgStamp(name string) dmesgStamp {
+	fi, err := os.Stat(fmt.Sprintf("%s/%s/dmesg.%s", kdumpCrashDir, name, name))
+	if err != nil {
+		return dmesgStamp{}
+	}
+	return dmesgStamp{fi.Size(), fi.ModTime()}
+}
+
+type analysisCacheEntry struct {
+	stamp    dmesgStamp
+	analysis *CrashAnalysis
+}
+
+var analysisCache = struct {
+	sync.Mutex
+	entries map[string]analysisCacheEntry
+}{entries: make(map[string]analysisCacheEntry)}
+
+// Get the analysis of a saved crash dump
+func GetCrashAnalysis(crashdump os.FileInfo) *CrashAnalysis {
+	name := crashdump.Name()
+	stamp := crashDMesgStamp(name)
+	analysisCache.Lock()
+	e, ok := analysisCache.entries[name]
+	analysisCache.Unlock()
+	if ok && e.stamp == stamp {
+		return e.analysis
+	}
+
+	dmesg, _ := GetCrashDMsg(crashdump)
+	a := AnalyzeDMesg(dmesg)
+	if dmesg == "" {
+		// Not cached, the kernel log may not be written yet
+		return a
+	}
+	analysisCache.Lock()
+	analysisCache.entries[name] = analysisCacheEntry{stamp, a}
+	analysisCache.Unlock()
+	return a
+}
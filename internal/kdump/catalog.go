@@ -0,0 +1,277 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	crashDirEvents = syscall.IN_CREATE | syscall.IN_DELETE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE |
+		syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	inotifyBufSize = 64 * 1024
+)
+
+type catalogEntry struct {
+	fi   os.FileInfo
+	size int64
+}
+
+// Catalog of the saved crash dumps and of the orphaned entries of the
+// crash directory. The crash directory is scanned when the catalog is
+// first read and again after inotify reports a change to the crash
+// directory or to a crash dump file. The orphaned entries are also
+// rescanned after any change inside a crash directory, and when a
+// temporary file becomes stale. Without inotify, the crash directory is
+// scanned on every read.
+var catalog = struct {
+	sync.Mutex
+	fd           int
+	rootWd       int
+	watches      map[int]string
+	gen          uint64 // incremented on every change
+	valid        bool
+	entries      []catalogEntry
+	orphansValid bool
+	orphans      *orphanScan
+}{fd: -1, watches: make(map[int]string)}
+
+// Drop the catalog so the crash directory is scanned on the next read.
+// Called for changes made by this service, so they are seen before the
+// inotify event is handled. Must be called with the catalog locked.
+func dropCatalog() {
+	catalog.gen++
+	catalog.valid = false
+	catalog.orphansValid = false
+}
+
+func invalidateCatalog() {
+	catalog.Lock()
+	dropCatalog()
+	catalog.Unlock()
+}
+
+// Start watching the crash directory. Must be called with the catalog
+// locked.
+func watchCrashDir() bool {
+	if catalog.fd >= 0 {
+		return true
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		log.Wlog.Println("Crash directory watch:", err)
+		return false
+	}
+	wd, err := syscall.InotifyAddWatch(fd, kdumpCrashDir, crashDirEvents)
+	if err != nil {
+		// The crash directory is created when the first dump is saved
+		syscall.Close(fd)
+		return false
+	}
+	catalog.fd = fd
+	catalog.rootWd = wd
+	catalog.watches = map[int]string{wd: ""}
+	dropCatalog()
+	go readCrashDirEvents(fd)
+	return true
+}
+
+// Stop watching the crash directory after it was removed or renamed, or
+// if reading events failed. Must be called with the catalog locked.
+func unwatchCrashDir(fd int) {
+	if catalog.fd != fd {
+		return
+	}
+	syscall.Close(fd)
+	catalog.fd = -1
+	catalog.watches = make(map[int]string)
+	dropCatalog()
+}
+
+// Watch the subdirectories of the crash directory, as crash dump files
+// are written, renamed and encrypted inside them. Must be called with the
+// catalog locked.
+func watchCrashSubdirs(dentries []os.FileInfo) {
+	if catalog.fd < 0 {
+		return
+	}
+	for _, d := range dentries {
+		if !d.IsDir() {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(catalog.fd,
+			fmt.Sprintf("%s/%s", kdumpCrashDir, d.Name()), crashDirEvents)
+		if err == nil {
+			catalog.watches[wd] = d.Name()
+		}
+	}
+}
+
+// Only changes of the vmcore affect the saved crash dumps. Changes to the
+// metadata and other files of a crash directory only affect the orphaned
+// entries.
+func isCatalogEvent(wd int, name string) bool {
+	if wd == catalog.rootWd || name == "" {
+		return true
+	}
+	return strings.HasPrefix(name, "dump") || strings.HasPrefix(name, "vmcore")
+}
+
+func readCrashDirEvents(fd int) {
+	buf := make([]byte, inotifyBufSize)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			catalog.Lock()
+			if catalog.fd == fd && err != nil {
+				log.Wlog.Println("Crash directory watch:", err)
+			}
+			unwatchCrashDir(fd)
+			catalog.Unlock()
+			return
+		}
+
+		catalog.Lock()
+		if catalog.fd != fd {
+			catalog.Unlock()
+			return
+		}
+		changed := false
+		touched := false
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			wd := int(ev.Wd)
+			switch {
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				changed = true
+			case ev.Mask&syscall.IN_IGNORED != 0:
+				delete(catalog.watches, wd)
+				continue
+			case wd == catalog.rootWd &&
+				ev.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+				unwatchCrashDir(fd)
+				catalog.Unlock()
+				return
+			case isCatalogEvent(wd, name):
+				changed = true
+			}
+			touched = true
+		}
+		if changed {
+			dropCatalog()
+		} else if touched {
+			catalog.gen++
+			catalog.orphansValid = false
+		}
+		catalog.Unlock()
+	}
+}
+
+// Scan the crash directory for saved crash dumps and orphaned entries.
+// Subdirectories are watched before they are checked, so changes made
+// during the scan invalidate it.
+func scanCrashDir() ([]catalogEntry, *orphanScan) {
+	entries := make([]catalogEntry, 0)
+	orphans := newOrphanScan()
+	dentries, err := ioutil.ReadDir(kdumpCrashDir)
+	if err != nil {
+		return entries, orphans
+	}
+	catalog.Lock()
+	watchCrashSubdirs(dentries)
+	catalog.Unlock()
+	for _, dentry := range dentries {
+		if reason := crashDirError(dentry); reason != "" {
+			orphans.entry(dentry, reason)
+			continue
+		}
+		orphans.crashDir(dentry.Name())
+		sz, _ := GetCrashSize(dentry.Name())
+		entries = append(entries, catalogEntry{dentry, sz})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ni, _ := strconv.ParseUint(entries[i].fi.Name(), 10, 0)
+		nj, _ := strconv.ParseUint(entries[j].fi.Name(), 10, 0)
+		return nj < ni
+	})
+	return entries, orphans
+}
+
+// Scan the crash directory and keep the result, unless the scan raced
+// with a change
+func rescanCatalog(gen uint64) ([]catalogEntry, *orphanScan) {
+	entries, orphans := scanCrashDir()
+
+	catalog.Lock()
+	if catalog.fd >= 0 && catalog.gen == gen {
+		catalog.entries = entries
+		catalog.valid = true
+		catalog.orphans = orphans
+		catalog.orphansValid = true
+	}
+	catalog.Unlock()
+	return entries, orphans
+}
+
+// Get the saved crash dumps, scanning the crash directory if the catalog
+// is not valid
+func catalogEntries() []catalogEntry {
+	catalog.Lock()
+	watchCrashDir()
+	if catalog.valid {
+		entries := catalog.entries
+		catalog.Unlock()
+		return entries
+	}
+	gen := catalog.gen
+	catalog.Unlock()
+
+	entries, _ := rescanCatalog(gen)
+	return entries
+}
+
+// Get the orphaned entries of the crash directory, scanning it if they
+// are not valid or a temporary file became stale since the last scan
+func catalogOrphans() []OrphanEntry {
+	catalog.Lock()
+	watchCrashDir()
+	if catalog.orphansValid &&
+		(catalog.orphans.expire.IsZero() || time.Now().Before(catalog.orphans.expire)) {
+		orphans := catalog.orphans.entries
+		catalog.Unlock()
+		return orphans
+	}
+	gen := catalog.gen
+	catalog.Unlock()
+
+	_, orphans := rescanCatalog(gen)
+	return orphans.entries
+}
+
+// Size of a saved crash dump from the catalog
+func CrashDumpSize(name string) (int64, error) {
+	for _, e := range catalogEntries() {
+		if e.fi.Name() == name {
+			return e.size, nil
+		}
+	}
+	return GetCrashSize(name)
+}
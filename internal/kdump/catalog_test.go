@@ -0,0 +1,202 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Use a temporary crash directory, with a fresh catalog, until cleanup is
+// called
+func setCrashDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetCatalog := func() {
+		catalog.Lock()
+		if catalog.fd >= 0 {
+			unwatchCrashDir(catalog.fd)
+		}
+		dropCatalog()
+		catalog.Unlock()
+	}
+	resetCatalog()
+	saved := kdumpCrashDir
+	kdumpCrashDir = dir
+	return dir, func() {
+		resetCatalog()
+		kdumpCrashDir = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func makeCrashDump(t *testing.T, dir, name string) {
+	t.Helper()
+	if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dump := filepath.Join(dir, name, "vmcore."+name)
+	if err := ioutil.WriteFile(dump, []byte("\x7fELF crash dump"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func catalogNames() []string {
+	names := make([]string, 0)
+	for _, e := range catalogEntries() {
+		names = append(names, e.fi.Name())
+	}
+	return names
+}
+
+func orphanPaths() []string {
+	paths := make([]string, 0)
+	for _, o := range GetOrphanedEntries() {
+		paths = append(paths, o.Path)
+	}
+	return paths
+}
+
+func TestCatalogConcurrentDeletes(t *testing.T) {
+	dir, cleanup := setCrashDir(t)
+	defer cleanup()
+	const ndumps = 40
+	names := make([]string, ndumps)
+	for i := range names {
+		names[i] = fmt.Sprintf("2026101912%02d", i)
+		makeCrashDump(t, dir, names[i])
+	}
+	if err := os.Mkdir(filepath.Join(dir, "junk"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := catalogNames(); len(got) != ndumps {
+		t.Fatalf("%d crash dumps in the catalog, want %d", len(got), ndumps)
+	}
+
+	// Delete every other crash dump while the catalog is read
+	var readers sync.WaitGroup
+	stop := make(chan struct{})
+	known := make(map[string]bool)
+	for _, n := range names {
+		known[n] = true
+	}
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				got := catalogNames()
+				if !sort.SliceIsSorted(got, func(i, j int) bool { return got[i] > got[j] }) {
+					t.Errorf("catalog not in reverse chronological order: %v", got)
+					return
+				}
+				for _, n := range got {
+					if !known[n] {
+						t.Errorf("unknown crash dump %s in the catalog", n)
+						return
+					}
+				}
+				orphanPaths()
+			}
+		}()
+	}
+	want := make([]string, 0)
+	for i, n := range names {
+		if i%2 == 0 {
+			if err := os.RemoveAll(filepath.Join(dir, n)); err != nil {
+				t.Error(err)
+			}
+		} else {
+			want = append(want, n)
+		}
+	}
+	close(stop)
+	readers.Wait()
+	sort.Sort(sort.Reverse(sort.StringSlice(want)))
+	wantOrphans := []string{filepath.Join(dir, "junk")}
+
+	// inotify events are handled asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := catalogNames()
+		orphans := orphanPaths()
+		if strings.Join(got, " ") == strings.Join(want, " ") &&
+			strings.Join(orphans, " ") == strings.Join(wantOrphans, " ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("catalog %v, orphans %v; want %v, %v", got, orphans, want, wantOrphans)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The settled catalog is served without scanning again
+	catalog.Lock()
+	valid, orphansValid := catalog.valid, catalog.orphansValid
+	catalog.Unlock()
+	if !valid || !orphansValid {
+		t.Errorf("catalog valid %v, orphans valid %v after settling", valid, orphansValid)
+	}
+}
+
+func TestCatalogOrphans(t *testing.T) {
+	dir, cleanup := setCrashDir(t)
+	defer cleanup()
+	makeCrashDump(t, dir, "202610191200")
+	write := func(name string, age time.Duration) {
+		t.Helper()
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(fname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("202610191200/dmesg.2026101912001234", time.Hour)
+	write("202610191200/meta.2026101912005678", 0)
+	if err := os.Mkdir(filepath.Join(dir, "202610191300"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write("202610191300/dmesg.202610191300", 0)
+	write("stray", 0)
+
+	want := map[string]bool{
+		filepath.Join(dir, "202610191200/dmesg.2026101912001234"): false,
+		filepath.Join(dir, "202610191300"):                        true,
+		filepath.Join(dir, "stray"):                               false,
+	}
+	orphans := GetOrphanedEntries()
+	if len(orphans) != len(want) {
+		t.Fatalf("orphans %+v, want %v", orphans, want)
+	}
+	for _, o := range orphans {
+		kept, ok := want[o.Path]
+		if !ok || o.Kept != kept {
+			t.Errorf("orphan %+v, want %v", o, want)
+		}
+	}
+
+	catalog.Lock()
+	expire := catalog.orphans.expire
+	catalog.Unlock()
+	if d := time.Until(expire); d <= 0 || d > tempFileMinAge {
+		t.Errorf("orphans expire in %s, want when the young temporary file is stale", d)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	crashToolTimeout = 10 * time.Minute
+	crashToolMarker  = "==vci-kdump-command-"
+)
+
+// The crash utility. This is a variable so that a stand-in can be used.
+var crashToolCmd = "/usr/bin/crash"
+
+var DefaultCrashCommands = []string{"bt", "log", "ps", "kmem -i", "mod"}
+
+// Crash utility commands that only read the crash dump. Commands that run
+// programs, read command files or write files, like extend, gdb, alias,
+// input and rd -r, are not allowed as they run as root.
+var crashToolCommands = map[string]bool{
+	"bt": true, "dev": true, "dis": true, "files": true, "foreach": true,
+	"fuser": true, "ipcs": true, "irq": true, "kmem": true, "list": true,
+	"log": true, "mach": true, "mod": true, "mount": true, "net": true,
+	"p": true, "ps": true, "pte": true, "ptob": true, "ptov": true,
+	"runq": true, "search": true, "sig": true, "struct": true,
+	"swap": true, "sym": true, "sys": true, "task": true, "timer": true,
+	"tree": true, "union": true, "vm": true, "vtop": true, "waitq": true,
+	"whatis": true,
+}
+
+// Check that a crash utility command is allowed. Shell escapes, pipes and
+// redirection run as root, and a newline would start another command.
+func CheckCrashCommand(c string) error {
+	if strings.ContainsAny(c, "!|<>\r\n") {
+		return fmt.Errorf("crash command %q: shell escapes, pipes, redirection and newlines are not allowed", c)
+	}
+	fields := strings.Fields(c)
+	if len(fields) == 0 {
+		return errors.New("empty crash command")
+	}
+	if !crashToolCommands[fields[0]] {
+		return fmt.Errorf("crash command %q is not allowed", fields[0])
+	}
+	return nil
+}
+
+type CrashCommandOutput struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+}
+
+// Output of a batch of crash utility commands, cached in the crash
+// directory
+type CrashToolResult struct {
+	Vmlinux  string               `json:"vmlinux"`
+	Time     time.Time            `json:"time"`
+	Commands []CrashCommandOutput `json:"commands"`
+}
+
+func crashToolCacheFile(name string) string {
+	return fmt.Sprintf("%s/%s/crash-commands.%s", kdumpCrashDir, name, name)
+}
+
+func (r *CrashToolResult) hasCommands(commands []string) bool {
+	cmds := make([]string, len(r.Commands))
+	for i, c := range r.Commands {
+		cmds[i] = c.Command
+	}
+	return reflect.DeepEqual(cmds, commands)
+}
+
+func readCrashToolCache(name string, commands []string) *CrashToolResult {
+	buf, err := ioutil.ReadFile(crashToolCacheFile(name))
+	if err != nil {
+		return nil
+	}
+	res := &CrashToolResult{}
+	if err := json.Unmarshal(buf, res); err != nil || !res.hasCommands(commands) {
+		return nil
+	}
+	return res
+}
+
+// Build the crash input script. Each command is preceded by a shell
+// escape that prints a marker, to split the output per command.
+func crashToolScript(commands []string) string {
+	var sb strings.Builder
+	for i, c := range commands {
+		fmt.Fprintf(&sb, "!echo %s%d==\n%s\n", crashToolMarker, i, c)
+	}
+	sb.WriteString("quit\n")
+	return sb.String()
+}
+
+func splitCrashToolOutput(out string, commands []string) []CrashCommandOutput {
+	res := make([]CrashCommandOutput, len(commands))
+	for i, c := range commands {
+		res[i].Command = c
+	}
+	current := -1
+	var sb strings.Builder
+	flush := func() {
+		if current >= 0 && current < len(res) {
+			res[current].Output = strings.TrimRight(sb.String(), "\n")
+		}
+		sb.Reset()
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, crashToolMarker) {
+			flush()
+			fmt.Sscanf(strings.TrimPrefix(line, crashToolMarker), "%d==", &current)
+			continue
+		}
+		if current >= 0 {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	flush()
+	return res
+}
+
+// Run the crash utility in batch mode and split its output per command
+func runCrashTool(vmlinux, dumpfile string, commands []string) ([]CrashCommandOutput, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), crashToolTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, crashToolCmd, "-s", "--no_scroll", vmlinux, dumpfile)
+	cmd.Stdin = strings.NewReader(crashToolScript(commands))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, errors.New("crash utility timed out")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("crash utility failed: %s: %s", err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return splitCrashToolOutput(string(out), commands), nil
+}
+
+// Run crash utility commands against a saved crash dump and the debug
+// vmlinux of the crashed kernel. The output is cached in the crash
+// directory unless refresh is requested.
+func RunCrashTool(crashdump os.FileInfo, commands []string, refresh bool) (*CrashToolResult, error) {
+	name := crashdump.Name()
+	if len(commands) == 0 {
+		commands = DefaultCrashCommands
+	}
+	for _, c := range commands {
+		if err := CheckCrashCommand(c); err != nil {
+			return nil, err
+		}
+	}
+	if !refresh {
+		if res := readCrashToolCache(name, commands); res != nil {
+			return res, nil
+		}
+	}
+
+	if IsEncrypted(name) {
+		return nil, errEncrypted
+	}
+	if _, err := os.Stat(crashToolCmd); err != nil {
+		return nil, fmt.Errorf("crash utility %s is not installed", crashToolCmd)
+	}
+	vmi, err := GetVMCoreInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	vmlinux, ok := DebugVmlinux(vmi)
+	if !ok {
+		return nil, fmt.Errorf("no debug vmlinux for kernel %s (build-id %s)",
+			vmi.KernelRelease, vmi.BuildID)
+	}
+
+	dumpfile, _ := CrashDumpFile(name)
+	outputs, err := runCrashTool(vmlinux, dumpfile, commands)
+	if err != nil {
+		return nil, err
+	}
+	res := &CrashToolResult{
+		Vmlinux:  vmlinux,
+		Time:     time.Now().UTC(),
+		Commands: outputs,
+	}
+	if buf, err := json.MarshalIndent(res, "", "  "); err == nil {
+		if err := safeWriteFile(crashToolCacheFile(name), buf); err != nil {
+			log.Wlog.Println("Cache crash utility output:", err)
+		}
+	}
+	return res, nil
+}
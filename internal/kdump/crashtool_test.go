@@ -0,0 +1,113 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Stand-in for the crash utility: it saves its arguments and input
+// script, runs the marker shell escapes and answers every other line
+// with a fixed output. Any other shell escape fails the run.
+const fakeCrashTool = `#!/bin/sh
+echo "$@" > "$0.args"
+cat > "$0.script"
+while IFS= read -r line; do
+	case "$line" in
+	"!echo ==vci-kdump-command-"*) echo "${line#!echo }" ;;
+	"!"*) echo "unexpected shell escape: $line" >&2; exit 1 ;;
+	quit) exit 0 ;;
+	*) echo "crash> $line"; echo "output of $line" ;;
+	esac
+done < "$0.script"
+echo "no quit" >&2
+exit 1
+`
+
+func setFakeCrashTool(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "crashtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(dir, "crash")
+	if err := ioutil.WriteFile(tool, []byte(fakeCrashTool), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	saved := crashToolCmd
+	crashToolCmd = tool
+	return tool, func() {
+		crashToolCmd = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRunCrashTool(t *testing.T) {
+	tool, cleanup := setFakeCrashTool(t)
+	defer cleanup()
+	commands := []string{"bt", "log -m", "kmem -i"}
+
+	outputs, err := runCrashTool("/vmlinux", "/dump", commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ioutil.ReadFile(tool + ".args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(args), "-s --no_scroll /vmlinux /dump\n"; got != want {
+		t.Errorf("arguments %q, want %q", got, want)
+	}
+	script, err := ioutil.ReadFile(tool + ".script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "!echo ==vci-kdump-command-0==\nbt\n" +
+		"!echo ==vci-kdump-command-1==\nlog -m\n" +
+		"!echo ==vci-kdump-command-2==\nkmem -i\n" +
+		"quit\n"
+	if string(script) != want {
+		t.Errorf("script %q, want %q", script, want)
+	}
+
+	if len(outputs) != len(commands) {
+		t.Fatalf("%d outputs, want %d", len(outputs), len(commands))
+	}
+	for i, c := range commands {
+		want := "crash> " + c + "\noutput of " + c
+		if outputs[i].Command != c || outputs[i].Output != want {
+			t.Errorf("output %d: %+v, want %q: %q", i, outputs[i], c, want)
+		}
+	}
+}
+
+func TestCheckCrashCommand(t *testing.T) {
+	for _, c := range []string{"bt", "bt -a", "log -m", "foreach bt", "struct task_struct.comm ffff8880"} {
+		if err := CheckCrashCommand(c); err != nil {
+			t.Errorf("%q: %s", c, err)
+		}
+	}
+	for _, c := range []string{
+		"",
+		"!sh",
+		"bt | sh",
+		"log > /etc/passwd",
+		"log < /dev/null",
+		"bt\n!sh",
+		"bt\r!sh",
+		"extend /tmp/evil.so",
+		"gdb shell id",
+		"alias ls !sh",
+		"wr jiffies 0",
+		"rd -r /tmp/x",
+	} {
+		if err := CheckCrashCommand(c); err == nil {
+			t.Errorf("%q was allowed", c)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kernel log levels, in the order of their numeric values
+var LogLevels = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+var logTimeRe = regexp.MustCompile(`^(?:<(\d+)>)?\[\s*(\d+)\.(\d+)\]`)
+
+// Selection of kernel log lines. Filters are applied in the order level,
+// match, window and tail, then the result is paged with offset and limit.
+type DMesgFilter struct {
+	Level  int // maximum log level shown, -1 for all
+	Match  *regexp.Regexp
+	Window bool    // only show lines around the panic
+	Before float64 // seconds before the panic
+	After  float64 // seconds after the panic
+	Tail   int     // last lines, 0 for all
+	Offset int
+	Limit  int // 0 for no limit
+}
+
+// Result of filtering a kernel log
+type DMesgPage struct {
+	DMesg        string
+	TotalLines   int
+	MatchedLines int
+	UnknownLevel int // lines left out by the level filter as their level is unknown
+}
+
+func (f *DMesgFilter) IsEmpty() bool {
+	return f == nil || (f.Level < 0 && f.Match == nil && !f.Window &&
+		f.Tail == 0 && f.Offset == 0 && f.Limit == 0)
+}
+
+// Numeric value of a log level name
+func LogLevel(name string) (int, bool) {
+	for i, l := range LogLevels {
+		if l == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+type dmesgLine struct {
+	text  string
+	level int     // -1 if unknown
+	time  float64 // seconds since boot, -1 if the line has no timestamp
+}
+
+func lineTimestamp(secs, frac string) float64 {
+	t, _ := strconv.ParseFloat(secs+"."+frac, 64)
+	return t
+}
+
+// Split a kernel log into lines. Lines without a timestamp continue the
+// previous message and take its level and time. Levels come from the
+// "<n>" line prefix, or from levels, the levels of the printk records by
+// timestamp, for logs saved without the prefix.
+func parseDMesgLines(dmesg string, levels map[string]int) []dmesgLine {
+	lines := make([]dmesgLine, 0)
+	level, ts := -1, -1.0
+	for _, text := range strings.Split(strings.TrimRight(dmesg, "\n"), "\n") {
+		if m := logTimeRe.FindStringSubmatch(text); m != nil {
+			ts = lineTimestamp(m[2], m[3])
+			level = -1
+			if m[1] != "" {
+				pri, _ := strconv.Atoi(m[1])
+				level = pri & 7
+			} else if l, ok := levels[m[2]+"."+m[3]]; ok {
+				level = l
+			}
+		}
+		lines = append(lines, dmesgLine{text, level, ts})
+	}
+	return lines
+}
+
+// Time of the panic, or of the last message if there is no panic message
+func panicTime(lines []dmesgLine) float64 {
+	last := -1.0
+	for _, l := range lines {
+		if panicRe.MatchString(l.text) {
+			return l.time
+		}
+		if l.time >= 0 {
+			last = l.time
+		}
+	}
+	return last
+}
+
+// Apply a filter to a kernel log
+func FilterDMesg(dmesg string, f *DMesgFilter, levels map[string]int) *DMesgPage {
+	lines := parseDMesgLines(dmesg, levels)
+	page := &DMesgPage{TotalLines: len(lines)}
+	if dmesg == "" {
+		page.TotalLines = 0
+		return page
+	}
+
+	t0 := 0.0
+	if f.Window {
+		t0 = panicTime(lines)
+	}
+	sel := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if f.Level >= 0 && l.level < 0 {
+			page.UnknownLevel++
+			continue
+		}
+		if f.Level >= 0 && l.level > f.Level {
+			continue
+		}
+		if f.Match != nil && !f.Match.MatchString(l.text) {
+			continue
+		}
+		if f.Window && (l.time < 0 || t0 < 0 ||
+			l.time < t0-f.Before || l.time > t0+f.After) {
+			continue
+		}
+		sel = append(sel, l.text)
+	}
+	if f.Tail > 0 && len(sel) > f.Tail {
+		sel = sel[len(sel)-f.Tail:]
+	}
+	page.MatchedLines = len(sel)
+
+	if f.Offset >= len(sel) {
+		sel = nil
+	} else {
+		sel = sel[f.Offset:]
+	}
+	if f.Limit > 0 && len(sel) > f.Limit {
+		sel = sel[:f.Limit]
+	}
+	if len(sel) != 0 {
+		page.DMesg = strings.Join(sel, "\n") + "\n"
+	}
+	return page
+}
+
+var dmesgLevelsCache = struct {
+	sync.Mutex
+	entries map[string]map[string]int
+}{entries: make(map[string]map[string]int)}
+
+// Levels of the kernel log messages of a crash dump by timestamp, for
+// kernel logs saved without levels. Empty if the crash dump is encrypted
+// or the printk buffer can't be read.
+func CrashDMesgLevels(name string) map[string]int {
+	dmesgLevelsCache.Lock()
+	levels, ok := dmesgLevelsCache.entries[name]
+	dmesgLevelsCache.Unlock()
+	if ok {
+		return levels
+	}
+
+	levels = readDMesgLevels(name)
+	if len(levels) == 0 {
+		// Not cached, the printk buffer may be readable later
+		return levels
+	}
+	dmesgLevelsCache.Lock()
+	dmesgLevelsCache.entries[name] = levels
+	dmesgLevelsCache.Unlock()
+	return levels
+}
+
+func readDMesgLevels(name string) map[string]int {
+	levels := make(map[string]int)
+	dumpfile, encrypted := CrashDumpFile(name)
+	if encrypted {
+		return levels
+	}
+	m, err := openDumpMemory(dumpfile)
+	if err != nil {
+		return levels
+	}
+	defer m.Close()
+	records, _ := readLogRecords(m)
+	for _, r := range records {
+		ts := fmt.Sprintf("%d.%06d", r.TsNsec/1000000000, r.TsNsec%1000000000/1000)
+		levels[ts] = r.Level
+	}
+	return levels
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"testing"
+)
+
+func TestFilterDMesgLevel(t *testing.T) {
+	dmesg := "<6>[    1.000000] info message\n" +
+		"<3>[    2.000000] error message\n" +
+		"    continued error message\n" +
+		"[    3.000000] message without level\n" +
+		"[    4.000000] message with level from the printk buffer\n"
+	levels := map[string]int{"4.000000": 2}
+
+	page := FilterDMesg(dmesg, &DMesgFilter{Level: 3}, levels)
+	want := "<3>[    2.000000] error message\n" +
+		"    continued error message\n" +
+		"[    4.000000] message with level from the printk buffer\n"
+	if page.DMesg != want {
+		t.Errorf("filtered kernel log %q, want %q", page.DMesg, want)
+	}
+	if page.TotalLines != 5 || page.MatchedLines != 3 || page.UnknownLevel != 1 {
+		t.Errorf("page %+v, want 5 lines, 3 matched, 1 of unknown level", page)
+	}
+
+	page = FilterDMesg(dmesg, &DMesgFilter{Level: -1, Tail: 2}, nil)
+	if page.MatchedLines != 2 || page.UnknownLevel != 0 {
+		t.Errorf("page %+v, want 2 lines matched without a level filter", page)
+	}
+}
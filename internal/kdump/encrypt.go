@@ -0,0 +1,247 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"errors"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	ageCmd = "/usr/bin/age"
+	gpgCmd = "/usr/bin/gpg"
+)
+
+// Suffixes of encrypted crash directory files
+var encryptedSuffixes = []string{".age", ".gpg"}
+
+// Encryption policy for saved crash dumps. Crash dumps are encrypted to
+// an age recipient or to an OpenPGP public key file.
+type Encryption struct {
+	AgeRecipient   string
+	PGPKeyFile     string
+	PlaintextDMesg bool // keep the kernel log unencrypted
+}
+
+var (
+	encryption = struct {
+		sync.Mutex
+		policy *Encryption
+	}{}
+	encryptMu    sync.Mutex
+	errEncrypted = errors.New("crash dump is encrypted")
+)
+
+func (e *Encryption) suffix() string {
+	if e.AgeRecipient != "" {
+		return ".age"
+	}
+	return ".gpg"
+}
+
+// Set the encryption policy. Saved crash dumps that are not encrypted yet
+// are encrypted in the background.
+func SetEncryption(e *Encryption) {
+	encryption.Lock()
+	encryption.policy = e
+	encryption.Unlock()
+	if e != nil {
+		go EncryptCrashDumps()
+	}
+}
+
+func encryptionPolicy() *Encryption {
+	encryption.Lock()
+	defer encryption.Unlock()
+	return encryption.policy
+}
+
+// Check if the kernel log of a crash dump may be returned in plaintext
+func DMesgAllowed() bool {
+	e := encryptionPolicy()
+	return e == nil || e.PlaintextDMesg
+}
+
+// Path of a crash directory file, or of its encrypted version if the file
+// has been encrypted. Also returns if the file is encrypted.
+func encryptedFile(fname string) (string, bool) {
+	if _, err := os.Stat(fname); err == nil {
+		return fname, false
+	}
+	for _, sfx := range encryptedSuffixes {
+		if _, err := os.Stat(fname + sfx); err == nil {
+			return fname + sfx, true
+		}
+	}
+	return fname, false
+}
+
+// Path of the vmcore of a saved crash dump and if it is encrypted
+func CrashDumpFile(name string) (string, bool) {
+	for _, f := range crashDumpNames(name) {
+		fname, encrypted := encryptedFile(crashDirFile(name, f))
+		if _, err := os.Stat(fname); err == nil {
+			return fname, encrypted
+		}
+	}
+	return crashDirFile(name, fmt.Sprintf("dump.%s", name)), false
+}
+
+func IsEncrypted(name string) bool {
+	_, encrypted := CrashDumpFile(name)
+	return encrypted
+}
+
+func encryptFile(e *Encryption, src string) (string, error) {
+	dst := src + e.suffix()
+	tmp := dst + ".tmp"
+	var cmd *exec.Cmd
+	if e.AgeRecipient != "" {
+		cmd = exec.Command(ageCmd, "--encrypt", "--recipient", e.AgeRecipient,
+			"--output", tmp, src)
+	} else {
+		// Use an empty keyring, the recipient key comes from the key file
+		home, err := ioutil.TempDir(runDir, "vci-kdump-gnupg")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(home)
+		cmd = exec.Command(gpgCmd, "--homedir", home, "--batch", "--yes",
+			"--trust-model", "always", "--recipient-file", e.PGPKeyFile,
+			"--output", tmp, "--encrypt", src)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("%s: %s: %s", path.Base(cmd.Path), err,
+			strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dst, nil
+}
+
+// Files of a crash directory holding kernel memory or kernel log contents
+func sensitiveFiles(e *Encryption, name string) []string {
+	dumpfile, _ := CrashDumpFile(name)
+	files := []string{
+		path.Base(dumpfile),
+		fmt.Sprintf("crash-commands.%s", name),
+	}
+	if !e.PlaintextDMesg {
+		files = append(files, fmt.Sprintf("dmesg.%s", name))
+		reports, _ := filepath.Glob(crashDirFile(name, fmt.Sprintf("report.%s.*", name)))
+		for _, r := range reports {
+			files = append(files, path.Base(r))
+		}
+	}
+	return files
+}
+
+// Keep what is needed to list a crash dump in its metadata, as it can't
+// be read from the encrypted vmcore
+func saveCrashDumpDetails(e *Encryption, crashdump os.FileInfo) error {
+	name := crashdump.Name()
+	vmi, err := GetVMCoreInfo(name)
+	if err != nil {
+		log.Wlog.Printf("VMCOREINFO %s: %s", name, err)
+	}
+	incomplete := IncompleteReason(name)
+	meta, err := UpdateDumpMeta(name, func(m *DumpMeta) {
+		if vmi != nil {
+			m.VMCoreInfo = vmi
+		}
+		m.Incomplete = incomplete
+	})
+	if err != nil {
+		return err
+	}
+
+	// The kernel log can't be extracted from the vmcore once encrypted, so
+	// the signature is computed now even if the kernel log is encrypted too
+	dmesg, source := readCrashDMsg(name)
+	if meta.Signature == "" {
+		saveCrashSignature(name, AnalyzeDMesg(dmesg))
+	}
+	if !e.PlaintextDMesg || source != DMesgSourceVMCore {
+		return nil
+	}
+	fname := crashDirFile(name, fmt.Sprintf("dmesg.%s", name))
+	if err := safeWriteFile(fname, []byte(dmesg)); err != nil {
+		return err
+	}
+	return updateManifestEntry(name, path.Base(fname))
+}
+
+// Encrypt the vmcore and other sensitive files of a saved crash dump in
+// place, and remove the plaintext. The plaintext is wiped if secure delete
+// is enabled.
+func encryptCrashDump(e *Encryption, name string) error {
+	encryptMu.Lock()
+	defer encryptMu.Unlock()
+
+	crashdump, err := os.Stat(fmt.Sprintf("%s/%s", kdumpCrashDir, name))
+	if err != nil {
+		return err
+	}
+	if !IsEncrypted(name) {
+		if err := saveCrashDumpDetails(e, crashdump); err != nil {
+			return err
+		}
+	}
+	encrypted := false
+	for _, file := range sensitiveFiles(e, name) {
+		fname := crashDirFile(name, file)
+		if _, err := os.Stat(fname); err != nil {
+			continue
+		}
+		encrypted = true
+		log.Ilog.Printf("Encrypting %s", fname)
+		encfile, err := encryptFile(e, fname)
+		if err != nil {
+			return err
+		}
+		if err := replaceManifestEntry(name, file, path.Base(encfile)); err != nil {
+			log.Wlog.Printf("Checksum manifest for %s: %s", name, err)
+		}
+		if err := removeFile(fname); err != nil {
+			return err
+		}
+	}
+	if encrypted {
+		forgetCrashDump(name)
+	}
+	return nil
+}
+
+// Encrypt all saved crash dumps according to the encryption policy
+func EncryptCrashDumps() {
+	e := encryptionPolicy()
+	if e == nil {
+		return
+	}
+	if e.AgeRecipient != "" {
+		if _, err := os.Stat(ageCmd); err != nil {
+			log.Elog.Printf("Crash dump encryption: %s is not installed", ageCmd)
+			return
+		}
+	} else if _, err := os.Stat(e.PGPKeyFile); err != nil {
+		log.Elog.Println("Crash dump encryption:", err)
+		return
+	}
+	_, crashdumps := GetCrashFiles()
+	for _, cd := range crashdumps {
+		if err := encryptCrashDump(e, cd.Name()); err != nil {
+			log.Elog.Printf("Encrypt crash dump %s: %s", cd.Name(), err)
+		}
+	}
+}
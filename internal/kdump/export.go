@@ -0,0 +1,417 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	zstdCmd = "/usr/bin/zstd"
+
+	CompressionGzip = "gzip"
+
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+
+	// Space kept free on the destination, and allowance for tar headers
+	exportReserve = 1 << 20
+)
+
+// Progress of an export of crash dumps to an archive
+type ExportProgress struct {
+	Archive string
+	Total   int64
+	Done    int64
+	Started time.Time
+	Status  string
+	Error   string
+}
+
+var exports = struct {
+	sync.Mutex
+	entries map[string]*ExportProgress
+}{entries: make(map[string]*ExportProgress)}
+
+var errExportDest = errors.New("export destination must be an absolute path")
+
+// Where crash dumps may be exported: the configuration partition, home
+// directories and mounted removable media
+var exportRoots = []string{"/config", "/home", "/media", "/mnt", "/run/media"}
+
+// Magic numbers of gzip and zstd streams, and of tar at offset 257
+var archiveMagic = []struct {
+	off   int64
+	magic string
+}{
+	{0, "\x1f\x8b"},
+	{0, "\x28\xb5\x2f\xfd"},
+	{257, "ustar"},
+}
+
+// File name extension of an archive
+func ArchiveSuffix(compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return ".tar.gz"
+	case CompressionZstd:
+		return ".tar.zst"
+	}
+	return ".tar"
+}
+
+// Files of a crash directory to export. Temporary files are skipped.
+func exportFiles(name string) ([]os.FileInfo, error) {
+	dentries, err := ioutil.ReadDir(crashDirFile(name, ""))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(dentries))
+	for _, d := range dentries {
+		if d.Mode().IsRegular() && !tempFileRe.MatchString(d.Name()) {
+			files = append(files, d)
+		}
+	}
+	return files, nil
+}
+
+// Size of the crash dump files of an export
+func exportSize(crashdumps []os.FileInfo) int64 {
+	var total int64
+	for _, cd := range crashdumps {
+		files, _ := exportFiles(cd.Name())
+		for _, f := range files {
+			total += f.Size()
+		}
+	}
+	return total
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: mtime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+type progressWriter struct {
+	w        io.Writer
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if p.progress != nil {
+		p.progress(int64(n))
+	}
+	return n, err
+}
+
+func copyTarFile(tw *tar.Writer, name string, fname string, progress func(int64)) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(&progressWriter{tw, progress}, f)
+	return err
+}
+
+// Write a tar archive of crash dumps with the kdump configuration. Each
+// crash directory is archived with the analysis of its kernel log. Encrypted
+// crash dump files are archived as they are.
+func WriteArchive(w io.Writer, crashdumps []os.FileInfo, config []byte, progress func(int64)) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	if env, err := ioutil.ReadFile(kdumpEnvFile); err == nil {
+		if err := addTarFile(tw, "kdump-config/kdump-tools", env, now); err != nil {
+			return err
+		}
+	}
+	if len(config) != 0 {
+		if err := addTarFile(tw, "kdump-config/config.json", config, now); err != nil {
+			return err
+		}
+	}
+	for _, cd := range crashdumps {
+		name := cd.Name()
+		files, err := exportFiles(name)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			err := copyTarFile(tw, path.Join(name, f.Name()), crashDirFile(name, f.Name()), progress)
+			if err != nil {
+				return err
+			}
+		}
+		analysis, err := json.MarshalIndent(GetCrashAnalysis(cd), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := addTarFile(tw, path.Join(name, "analysis.json"), append(analysis, '\n'), now); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Write a compressed tar archive of crash dumps
+func writeCompressedArchive(w io.Writer, crashdumps []os.FileInfo, config []byte,
+	compression string, progress func(int64)) error {
+	switch compression {
+	case CompressionGzip:
+		zw := gzip.NewWriter(w)
+		if err := WriteArchive(zw, crashdumps, config, progress); err != nil {
+			return err
+		}
+		return zw.Close()
+	case CompressionZstd:
+		cmd := exec.Command(zstdCmd, "-q", "-c", "-T0")
+		cmd.Stdout = w
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		err = WriteArchive(stdin, crashdumps, config, progress)
+		stdin.Close()
+		if werr := cmd.Wait(); err == nil && werr != nil {
+			err = fmt.Errorf("%s: %s", path.Base(zstdCmd), werr)
+		}
+		return err
+	}
+	return WriteArchive(w, crashdumps, config, progress)
+}
+
+// Check that a filesystem has room for a file of the given size
+func checkFreeSpace(dir string, size int64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	free := int64(st.Bavail) * int64(st.Bsize)
+	if free < size+exportReserve {
+		return fmt.Errorf("not enough space in %s: %d MB needed, %d MB available",
+			dir, (size+exportReserve)>>20, free>>20)
+	}
+	return nil
+}
+
+func isExportRoot(dir string) bool {
+	for _, root := range exportRoots {
+		if dir == root || strings.HasPrefix(dir, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a file is an archive, from its name and contents
+func isArchiveFile(fname string) bool {
+	if !strings.HasSuffix(fname, ".tar") && !strings.HasSuffix(fname, ".tar.gz") &&
+		!strings.HasSuffix(fname, ".tar.zst") {
+		return false
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	for _, m := range archiveMagic {
+		buf := make([]byte, len(m.magic))
+		if _, err := f.ReadAt(buf, m.off); err == nil && string(buf) == m.magic {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that an export does not overwrite anything but an archive
+func checkExportTarget(archive string) error {
+	fi, err := os.Lstat(archive)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || !isArchiveFile(archive) {
+		return fmt.Errorf("%s exists and is not an archive, not overwriting it", archive)
+	}
+	return nil
+}
+
+// Path of the archive for an export destination. A destination that is a
+// directory gets an archive named after the current time. The archive
+// must be under one of the export roots once symbolic links are resolved,
+// and may only replace an existing archive.
+func exportArchivePath(dest, compression string) (string, error) {
+	if !filepath.IsAbs(dest) {
+		return "", errExportDest
+	}
+	for _, elem := range strings.Split(dest, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("export destination %s must not contain ..", dest)
+		}
+	}
+	archive := filepath.Clean(dest)
+	if fi, err := os.Stat(archive); err == nil && fi.IsDir() {
+		name := "crash-dumps-" + time.Now().Format("20060102150405") + ArchiveSuffix(compression)
+		archive = filepath.Join(archive, name)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(archive))
+	if err != nil {
+		return "", err
+	}
+	if !isExportRoot(dir) {
+		return "", fmt.Errorf("export destination must be under %s",
+			strings.Join(exportRoots, ", "))
+	}
+	archive = filepath.Join(dir, filepath.Base(archive))
+	if err := checkExportTarget(archive); err != nil {
+		return "", err
+	}
+	return archive, nil
+}
+
+func runExport(p *ExportProgress, crashdumps []os.FileInfo, config []byte, compression string) {
+	progress := func(n int64) {
+		exports.Lock()
+		p.Done += n
+		exports.Unlock()
+	}
+	// The temporary file gets a new random name, as the destination
+	// directory may be writable by other users
+	tmp := ""
+	err := func() error {
+		f, err := ioutil.TempFile(filepath.Dir(p.Archive), filepath.Base(p.Archive)+".*.tmp")
+		if err != nil {
+			return err
+		}
+		tmp = f.Name()
+		if err := writeCompressedArchive(f, crashdumps, config, compression, progress); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := checkExportTarget(p.Archive); err != nil {
+			return err
+		}
+		return os.Rename(tmp, p.Archive)
+	}()
+
+	exports.Lock()
+	defer exports.Unlock()
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		p.Status = ExportFailed
+		p.Error = err.Error()
+		log.Elog.Printf("Export crash dumps to %s: %s", p.Archive, err)
+		return
+	}
+	p.Status = ExportDone
+	log.Ilog.Printf("Exported %d crash dumps to %s in %s", len(crashdumps), p.Archive,
+		time.Since(p.Started).Round(time.Second))
+}
+
+// Start exporting crash dumps to an archive at a local destination, after
+// checking there is enough space for the uncompressed archive. Returns the
+// path of the archive.
+func ExportCrashDumps(crashdumps []os.FileInfo, dest string, compression string,
+	config []byte) (*ExportProgress, error) {
+	if len(crashdumps) == 0 {
+		return nil, errors.New("no crash dumps to export")
+	}
+	archive, err := exportArchivePath(dest, compression)
+	if err != nil {
+		return nil, err
+	}
+	if compression == CompressionZstd {
+		if _, err := os.Stat(zstdCmd); err != nil {
+			return nil, fmt.Errorf("%s is not installed", zstdCmd)
+		}
+	}
+	total := exportSize(crashdumps)
+	if err := checkFreeSpace(filepath.Dir(archive), total); err != nil {
+		return nil, err
+	}
+
+	p := &ExportProgress{
+		Archive: archive,
+		Total:   total,
+		Started: time.Now(),
+		Status:  ExportRunning,
+	}
+	exports.Lock()
+	if old, ok := exports.entries[archive]; ok && old.Status == ExportRunning {
+		exports.Unlock()
+		return nil, fmt.Errorf("export to %s is already running", archive)
+	}
+	exports.entries[archive] = p
+	exports.Unlock()
+	log.Ilog.Printf("Exporting %d crash dumps to %s", len(crashdumps), archive)
+	go runExport(p, crashdumps, config, compression)
+	res := *p
+	return &res, nil
+}
+
+// Exports in progress and finished since the service started
+func GetExports() []ExportProgress {
+	exports.Lock()
+	defer exports.Unlock()
+	res := make([]ExportProgress, 0, len(exports.entries))
+	for _, p := range exports.entries {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Started.Before(res[j].Started)
+	})
+	return res
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use a temporary export root, and a directory outside of it, until
+// cleanup is called
+func setExportRoot(t *testing.T) (string, string, func()) {
+	t.Helper()
+	root, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	saved := exportRoots
+	exportRoots = []string{root}
+	return root, outside, func() {
+		exportRoots = saved
+		os.RemoveAll(root)
+		os.RemoveAll(outside)
+	}
+}
+
+func TestExportArchivePath(t *testing.T) {
+	root, outside, cleanup := setExportRoot(t)
+	defer cleanup()
+
+	write := func(name, contents string) string {
+		t.Helper()
+		fname := filepath.Join(root, name)
+		if err := ioutil.WriteFile(fname, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	archive := write("old.tar.gz", "\x1f\x8b compressed")
+	notArchive := write("notes.tar", "not a tar archive")
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := exportArchivePath(root, CompressionGzip)
+	if err != nil || filepath.Dir(p) != root || !strings.HasSuffix(p, ".tar.gz") {
+		t.Errorf("directory destination: %q, %v", p, err)
+	}
+	if p, err := exportArchivePath(archive, CompressionGzip); err != nil || p != archive {
+		t.Errorf("existing archive: %q, %v", p, err)
+	}
+	for _, dest := range []string{
+		"relative.tar",
+		filepath.Join(outside, "dumps.tar"),
+		root + "/../" + filepath.Base(outside) + "/dumps.tar",
+		filepath.Join(root, "link", "dumps.tar"),
+		notArchive,
+		"/etc/passwd",
+	} {
+		if p, err := exportArchivePath(dest, ""); err == nil {
+			t.Errorf("%s: allowed as %s", dest, p)
+		}
+	}
+}
+
+func TestExportTempFileSymlink(t *testing.T) {
+	dir, cleanupCrashDir := setCrashDir(t)
+	defer cleanupCrashDir()
+	root, outside, cleanup := setExportRoot(t)
+	defer cleanup()
+
+	makeCrashDump(t, dir, "202610191200")
+	victim := filepath.Join(outside, "victim")
+	if err := ioutil.WriteFile(victim, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(root, "dumps.tar")
+	if err := os.Symlink(victim, archive+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	crashdump, err := os.Stat(filepath.Join(dir, "202610191200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ExportProgress{Archive: archive, Started: time.Now(), Status: ExportRunning}
+	runExport(p, []os.FileInfo{crashdump}, nil, CompressionNone)
+	if p.Status != ExportDone {
+		t.Fatalf("export %s: %s", p.Status, p.Error)
+	}
+
+	if contents, err := ioutil.ReadFile(victim); err != nil || string(contents) != "keep me" {
+		t.Errorf("symlink target changed: %d bytes, %v", len(contents), err)
+	}
+	if target, err := os.Readlink(archive + ".tmp"); err != nil || target != victim {
+		t.Errorf("symlink changed: %q, %v", target, err)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(hdr.Name, "vmcore.202610191200") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("crash dump missing from the archive")
+	}
+	if leftover, _ := filepath.Glob(archive + ".*.tmp"); len(leftover) != 0 {
+		t.Errorf("temporary files left: %v", leftover)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const httpErrorBodyMax = 512
+
+// Upload with HTTP PUT. A PUT replaces the file, so interrupted uploads
+// start over. The SHA-256 of the file is sent in the Digest and
+// X-Checksum-Sha256 headers, and is checked against the X-Checksum-Sha256
+// header of a HEAD request after upload, for artifact stores that report it.
+type httpUploader struct {
+	client *http.Client
+	base   *url.URL
+	token  string
+}
+
+// HTTP client for uploads, trusting the CA certificates of caFile if set
+// instead of the system ones
+func uploadHTTPClient(caFile string) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Minute,
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func newHTTPUploader(d *UploadDest, u *url.URL) (*httpUploader, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in upload URL %s", d.URL)
+	}
+	client, err := uploadHTTPClient(d.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &httpUploader{client: client, base: u, token: d.BearerToken}, nil
+}
+
+func (h *httpUploader) url(file string) string {
+	u := *h.base
+	u.Path = path.Join("/", u.Path, file)
+	u.RawPath = ""
+	return u.String()
+}
+
+// Error for an HTTP response that isn't a success, with the start of
+// the response body
+func httpError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, httpErrorBodyMax))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		return errors.New(resp.Status)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, msg)
+}
+
+func (h *httpUploader) do(req *http.Request) (*http.Response, error) {
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, httpError(resp)
+	}
+	return resp, nil
+}
+
+func (h *httpUploader) mkdir(dir string) error {
+	return nil
+}
+
+func (h *httpUploader) put(local, remote, sum string) (bool, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPut, h.url(remote), f)
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if raw, err := hex.DecodeString(sum); err == nil {
+		req.Header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(raw))
+	}
+	req.Header.Set("X-Checksum-Sha256", sum)
+	resp, err := h.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return false, nil
+}
+
+func (h *httpUploader) sha256(file string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, h.url(file), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := h.do(req)
+	if err != nil {
+		// Not every server allows HEAD
+		return "", nil
+	}
+	resp.Body.Close()
+	sum := strings.ToLower(resp.Header.Get("X-Checksum-Sha256"))
+	if !sha256Re.MatchString(sum) {
+		return "", nil
+	}
+	return sum, nil
+}
+
+func (h *httpUploader) remove(file string) error {
+	req, err := http.NewRequest(http.MethodDelete, h.url(file), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
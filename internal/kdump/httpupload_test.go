@@ -0,0 +1,107 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestHTTPUploadBearerToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "vmcore.202610191200")
+	data := bytes.Repeat([]byte("crash dump data\n"), 1000)
+	if err := ioutil.WriteFile(local, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileSHA256(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Artifact store reporting the SHA-256 of stored files, optionally
+	// not allowing HEAD
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+	allowHead := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get("X-Checksum-Sha256") != sum {
+				http.Error(w, "bad checksum header", http.StatusBadRequest)
+				return
+			}
+			files[r.URL.Path] = body
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodHead:
+			body, ok := files[r.URL.Path]
+			if !allowHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s := sha256.Sum256(body)
+			w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(s[:]))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	d := &UploadDest{Name: "store", URL: srv.URL + "/crash", BearerToken: "s3cret"}
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHTTPUploader(d, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfile := "202610191200/vmcore.202610191200"
+	resumed, verified, err := uploadFile(h, local, rfile, sum)
+	if err != nil || resumed || !verified {
+		t.Fatalf("upload: resumed %v, verified %v, %v", resumed, verified, err)
+	}
+	if got := files["/crash/"+rfile]; !bytes.Equal(got, data) {
+		t.Errorf("uploaded file differs: %d bytes", len(got))
+	}
+
+	mu.Lock()
+	allowHead = false
+	mu.Unlock()
+	resumed, verified, err = uploadFile(h, local, rfile, sum)
+	if err != nil || verified {
+		t.Errorf("upload without HEAD: verified %v, %v", verified, err)
+	}
+
+	d.BearerToken = "wrong"
+	if h, err = newHTTPUploader(d, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := uploadFile(h, local, rfile, sum); err == nil {
+		t.Error("upload with a wrong token succeeded")
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	crashDirNameFormat = "200601021504" // YYYYMMDDhhmm
+	importDirSuffix    = ".import"
+)
+
+// Where an imported crash dump came from
+type ImportSource struct {
+	Path        string `json:"path"`
+	Description string `json:"description,omitempty"`
+	Time        string `json:"time"`
+}
+
+// Result of importing a crash dump
+type ImportResult struct {
+	Name       string
+	Format     string
+	VMCoreInfo *VMCoreInfo
+	Incomplete string
+	DMesgLines int
+	DMesgError string // why the kernel log was not extracted
+}
+
+// Crash directory names reserved by imports in progress, so imports don't
+// pick the same name and their temporary directories are not orphaned
+var importing = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// Copies the crash dump file of an import
+var importCopyFile = copyFile
+
+func isImporting(dname string) bool {
+	if !strings.HasSuffix(dname, importDirSuffix) {
+		return false
+	}
+	importing.Lock()
+	defer importing.Unlock()
+	return importing.names[strings.TrimSuffix(dname, importDirSuffix)]
+}
+
+// Check that a file is a crash dump this system can analyse: a
+// kdump-compressed dump or an ELF core, like those of makedumpfile or
+// virsh dump --memory-only, with VMCOREINFO
+func checkImportFile(fname string) (string, *VMCoreInfo, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("%s: not a regular file", fname)
+	}
+	format := dumpFormat(f)
+	switch format {
+	case DumpFormatKdump:
+		if _, err := readDiskDumpHeader(f); err != nil {
+			return "", nil, fmt.Errorf("%s: %s", fname, err)
+		}
+	case DumpFormatELF:
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		if ef.Type != elf.ET_CORE {
+			return "", nil, fmt.Errorf("%s: not an ELF core file", fname)
+		}
+	default:
+		return "", nil, fmt.Errorf("%s: not a kdump-compressed or ELF crash dump", fname)
+	}
+	vmi, err := ReadVMCoreInfo(fname)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: no VMCOREINFO: %s", fname, err)
+	}
+	return format, vmi, nil
+}
+
+// Reserve a name for the crash directory of an imported crash dump, from
+// the crash time if known, and create its temporary directory. Later
+// minutes are tried if the name is taken. The name is reserved until
+// releaseImportDir is called.
+func reserveImportDir(vmi *VMCoreInfo) (string, error) {
+	t := time.Now()
+	if vmi.CrashTime != 0 {
+		t = time.Unix(vmi.CrashTime, 0)
+	}
+	importing.Lock()
+	defer importing.Unlock()
+	for i := 0; i < 60; i++ {
+		name := t.Add(time.Duration(i) * time.Minute).Format(crashDirNameFormat)
+		crashdir := fmt.Sprintf("%s/%s", kdumpCrashDir, name)
+		if importing.names[name] {
+			continue
+		}
+		if _, err := os.Lstat(crashdir); !os.IsNotExist(err) {
+			continue
+		}
+		err := os.Mkdir(crashdir+importDirSuffix, 0755)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		importing.names[name] = true
+		return name, nil
+	}
+	return "", errors.New("no free crash directory name")
+}
+
+func releaseImportDir(name string) {
+	importing.Lock()
+	delete(importing.names, name)
+	importing.Unlock()
+}
+
+// Import a crash dump copied from another system or dumped from a virtual
+// machine. The crash dump is copied to a new crash directory with its
+// kernel log and where it came from, and is then handled like a captured
+// one. The crash directory is built under a temporary name so a failed
+// import leaves no partial crash dump. It returns once the crash dump is
+// copied and its kernel log extracted, which can take minutes for a large
+// crash dump; imports of several crash dumps run concurrently.
+func ImportCrashDump(fname, description string) (*ImportResult, error) {
+	if !filepath.IsAbs(fname) {
+		return nil, fmt.Errorf("%s: not an absolute path", fname)
+	}
+	fname = filepath.Clean(fname)
+	if strings.HasPrefix(fname, kdumpCrashDir+"/") {
+		return nil, fmt.Errorf("%s is already in %s", fname, kdumpCrashDir)
+	}
+	format, vmi, err := checkImportFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFreeSpace(kdumpCrashDir, fi.Size()); err != nil {
+		return nil, err
+	}
+
+	name, err := reserveImportDir(vmi)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseImportDir(name)
+	crashdir := fmt.Sprintf("%s/%s", kdumpCrashDir, name)
+	tmpdir := crashdir + importDirSuffix
+	done := false
+	defer func() {
+		if !done {
+			os.RemoveAll(tmpdir)
+		}
+	}()
+
+	// Named like the output of makedumpfile, or of the fallback copy of
+	// /proc/vmcore for ELF dumps
+	dumpfile := fmt.Sprintf("%s/dump.%s", tmpdir, name)
+	if format == DumpFormatELF {
+		dumpfile = fmt.Sprintf("%s/vmcore.%s", tmpdir, name)
+	}
+	log.Ilog.Printf("Importing crash dump %s as %s", fname, name)
+	if err := importCopyFile(fname, dumpfile); err != nil {
+		return nil, err
+	}
+
+	res := &ImportResult{Name: name, Format: format, VMCoreInfo: vmi}
+	res.Incomplete = checkCrashDump(dumpfile)
+	dmesg, err := ExtractDMesg(dumpfile)
+	if err != nil {
+		res.DMesgError = err.Error()
+	}
+	if dmesg != "" {
+		dmesgFile := fmt.Sprintf("%s/dmesg.%s", tmpdir, name)
+		if err := safeWriteFile(dmesgFile, []byte(dmesg)); err != nil {
+			return nil, err
+		}
+		res.DMesgLines = strings.Count(dmesg, "\n")
+	}
+
+	meta := &DumpMeta{
+		VMCoreInfo: vmi,
+		Incomplete: res.Incomplete,
+		Imported: &ImportSource{
+			Path:        fname,
+			Description: description,
+			Time:        time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	buf, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	metaFile := fmt.Sprintf("%s/meta.%s", tmpdir, name)
+	if err := safeWriteFile(metaFile, append(buf, '\n')); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmpdir, crashdir); err != nil {
+		return nil, err
+	}
+	done = true
+	forgetCrashDump(name)
+	EnsureManifest(name)
+	return res, nil
+}
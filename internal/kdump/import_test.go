@@ -0,0 +1,139 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write an ELF core with only a VMCOREINFO note, like a vmcore without
+// memory
+func writeELFCore(t *testing.T, fname, vmcoreinfo string) {
+	t.Helper()
+	le := binary.LittleEndian
+	var note bytes.Buffer
+	name := vmcoreInfoNoteName + "\x00"
+	binary.Write(&note, le, [3]uint32{uint32(len(name)), uint32(len(vmcoreinfo)), 0})
+	note.WriteString(name)
+	note.Write(make([]byte, (4-len(name)%4)%4))
+	note.WriteString(vmcoreinfo)
+	note.Write(make([]byte, (4-len(vmcoreinfo)%4)%4))
+
+	const ehsize, phentsize = 64, 56
+	var buf bytes.Buffer
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehsize,
+		Ehsize:    ehsize,
+		Phentsize: phentsize,
+		Phnum:     1,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&buf, le, hdr)
+	binary.Write(&buf, le, elf.Prog64{
+		Type:   uint32(elf.PT_NOTE),
+		Off:    ehsize + phentsize,
+		Filesz: uint64(note.Len()),
+	})
+	buf.Write(note.Bytes())
+	if err := ioutil.WriteFile(fname, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Wait for the manifests started in the background to be written
+func waitManifests(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		manifestJobs.Lock()
+		pending := len(manifestJobs.pending)
+		manifestJobs.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("manifests not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImportCrashDump(t *testing.T) {
+	dir, cleanup := setCrashDir(t)
+	defer cleanup()
+	src, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	crashTime := time.Date(2026, 10, 19, 12, 0, 30, 0, time.Local)
+	vmcore := filepath.Join(src, "guest.vmcore")
+	writeELFCore(t, vmcore, fmt.Sprintf("OSRELEASE=5.4.0-test\nPAGESIZE=4096\nCRASHTIME=%d\n",
+		crashTime.Unix()))
+
+	res, err := ImportCrashDump(vmcore, "guest vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitManifests(t)
+	if res.Name != "202610191200" || res.Format != DumpFormatELF ||
+		res.VMCoreInfo.KernelRelease != "5.4.0-test" {
+		t.Errorf("import result %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, res.Name, "vmcore."+res.Name)); err != nil {
+		t.Error(err)
+	}
+	meta, err := ReadDumpMeta(res.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Imported == nil || meta.Imported.Path != vmcore || meta.Imported.Description != "guest vm1" {
+		t.Errorf("import source %+v", meta.Imported)
+	}
+
+	// The name is taken, so the next minute is used. A failed import
+	// leaves nothing in the crash directory.
+	saved := importCopyFile
+	defer func() { importCopyFile = saved }()
+	importCopyFile = func(src, dst string) error {
+		if filepath.Base(filepath.Dir(dst)) != "202610191201"+importDirSuffix {
+			t.Errorf("copied to %s", dst)
+		}
+		return errors.New("no space left on device")
+	}
+	if _, err := ImportCrashDump(vmcore, ""); err == nil {
+		t.Fatal("import succeeded")
+	}
+	dentries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dentries {
+		if d.Name() != res.Name {
+			t.Errorf("%s left in the crash directory", d.Name())
+		}
+	}
+	if isImporting("202610191201" + importDirSuffix) {
+		t.Error("crash directory name still reserved")
+	}
+
+	if _, err := ImportCrashDump(filepath.Join(dir, res.Name, "vmcore."+res.Name), ""); err == nil {
+		t.Error("import from the crash directory succeeded")
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// Compression of the pages of a crash dump
+const (
+	CompressionNone   = "none"
+	CompressionZlib   = "zlib"
+	CompressionLZO    = "lzo"
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+)
+
+// File of a crash directory
+type CrashFile struct {
+	Name string
+	Size int64
+}
+
+// Details of a saved crash dump
+type CrashInfo struct {
+	Name         string
+	Format       string
+	DumpLevel    int // -1 if unknown
+	Compression  string
+	VMCoreInfo   *VMCoreInfo
+	PanicMessage string
+	Signature    string
+	Encrypted    bool
+	Incomplete   string
+	Integrity    string
+	Verified     string
+	Checksums    []ManifestEntry
+	Notes        string
+	Pinned       bool
+	Imported     *ImportSource
+	Files        []CrashFile
+}
+
+func diskDumpCompression(status uint32) string {
+	switch {
+	case status&dumpDHCompressedZlib != 0:
+		return CompressionZlib
+	case status&dumpDHCompressedLZO != 0:
+		return CompressionLZO
+	case status&dumpDHCompressedSnappy != 0:
+		return CompressionSnappy
+	case status&dumpDHCompressedZstd != 0:
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// Read the format, dump level and compression from the vmcore header
+func (ci *CrashInfo) readDumpHeader(dumpfile string) {
+	f, err := os.Open(dumpfile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	ci.Format = dumpFormat(f)
+	switch ci.Format {
+	case DumpFormatKdump:
+		h, err := readDiskDumpHeader(f)
+		if err != nil {
+			return
+		}
+		ci.DumpLevel = int(h.DumpLevel)
+		ci.Compression = diskDumpCompression(h.Status)
+	case DumpFormatELF:
+		ci.Compression = CompressionNone
+	}
+}
+
+// Get the details of a saved crash dump. For an encrypted crash dump, the
+// details saved before encryption are returned.
+func GetCrashInfo(crashdump os.FileInfo) *CrashInfo {
+	name := crashdump.Name()
+	ci := &CrashInfo{
+		Name:      name,
+		Format:    DumpFormatUnknown,
+		DumpLevel: -1,
+	}
+	dumpfile, encrypted := CrashDumpFile(name)
+	ci.Encrypted = encrypted
+	if !encrypted {
+		ci.readDumpHeader(dumpfile)
+	}
+	if vmi, err := GetVMCoreInfo(name); err == nil {
+		ci.VMCoreInfo = vmi
+		if ci.Format == DumpFormatUnknown {
+			ci.Format = vmi.Format
+		}
+	}
+	if a := GetCrashAnalysis(crashdump); a != nil {
+		ci.PanicMessage = a.PanicMessage
+	}
+	ci.Signature = GetCrashSignature(crashdump)
+	ci.Incomplete = IncompleteReason(name)
+	ci.Integrity, ci.Verified = GetCrashIntegrity(crashdump)
+	ci.Checksums, _ = ReadManifest(name)
+	if meta, err := ReadDumpMeta(name); err == nil {
+		ci.Notes = meta.Notes
+		ci.Pinned = meta.Pinned
+		ci.Imported = meta.Imported
+	}
+
+	dentries, _ := ioutil.ReadDir(crashDirFile(name, ""))
+	for _, d := range dentries {
+		if d.Mode().IsRegular() {
+			ci.Files = append(ci.Files, CrashFile{d.Name(), d.Size()})
+		}
+	}
+	return ci
+}
@@ -13,7 +13,6 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -23,9 +22,10 @@ const (
 	kdumpLoadService                  = "vyatta-kdump-load.service"
 	kdumpEnvFile                      = "/etc/default/kdump-tools"
 	kdumpCmd                          = "/usr/sbin/kdump-config"
-	kdumpCrashDir                     = "/var/crash"
 	kdumpDir                          = "/var/lib/kdump"
 	kdumpLastBootFile                 = "kdump-last-boot-crashed"
+	kdumpSavecoreStatus               = "vyatta-kdump-status"
+	kdumpModulesFile                  = "kdump-modules"
 	kernelCmdLine                     = "/proc/cmdline"
 	grubEditEnvCmd                    = "/opt/vyatta/sbin/vyatta-grub-editenv"
 	initrdStateFile                   = kdumpDir + ".initrd-created"
@@ -39,11 +39,22 @@ const (
 	runDir                            = "/run"
 )
 
+// Where crash dumps are saved. Changed by tests.
+var kdumpCrashDir = "/var/crash"
+
 const (
 	KDumpNotReady = iota
 	KDumpReady
 )
 
+// Source of the kernel log returned by GetCrashDMsg
+const (
+	DMesgSourceFile      = "dmesg-file"
+	DMesgSourceVMCore    = "vmcore"
+	DMesgSourceNone      = "none"
+	DMesgSourceEncrypted = "encrypted" // withheld by the encryption policy
+)
+
 const envFile = `### Autogenerate by vci-kdump
 ### Note: Manual change to this file will be lost during next commit
 ### kdump-tools defaults are in comments.
@@ -56,8 +67,11 @@ KDUMP_INITRD={{.Initrd}}
 #KDUMP_DUMP_DMESG=
 KDUMP_COREDIR="/var/crash"
 KDUMP_DUMP_DMESG=1
-KDUMP_NUM_DUMPS={{.NumDumps}}
+#KDUMP_NUM_DUMPS=0
+### The number of dumps is limited by kdump-config.vyatta, which keeps pinned dumps
+VYATTA_KDUMP_NUM_DUMPS={{.NumDumps}}
 KDUMP_DELETE_OLD={{.DeleteOld}}
+VYATTA_KDUMP_SECURE_DELETE={{.SecureDelete}}
 #MAKEDUMP_ARGS="-c -d 31"
 #KDUMP_KEXEC_ARGS=""
 #KDUMP_CMDLINE=""
@@ -69,6 +83,9 @@ var CrashKernelParam string // Kernel command line parameter "crashkernel"
 var envFileTemplate *template.Template
 var lastBootCrashStatus string
 
+// Crash dump saved by the last boot, if it crashed
+var lastBootCrashDump string
+
 func init() {
 	envFileTemplate = template.Must(template.New("KDumpEnv").Parse(envFile))
 	var err error
@@ -80,7 +97,7 @@ func init() {
 	if err != nil {
 		log.Wlog.Println("Error in getting CrashKernelMemory:", err)
 	}
-	lastBootCrashStatus = getLastBootCrashStatus()
+	lastBootCrashStatus, lastBootCrashDump = getLastBootCrashStatus()
 }
 
 // return crash kernel memory in bytes
@@ -111,7 +128,7 @@ func GetCrashKernelParam() (string, error) {
 func GetKDumpState() int {
 	out, err := ioutil.ReadFile(kexecCrashLoadedPath)
 	if err != nil {
-		log.Elog.Println("Cannot Read File %s: %v", kexecCrashLoadedPath, err)
+		log.Elog.Printf("Cannot Read File %s: %v", kexecCrashLoadedPath, err)
 		return KDumpNotReady
 	}
 	s := strings.TrimSpace(string(out))
@@ -128,17 +145,21 @@ func GetKDumpState() int {
 
 func WriteEnv(numfile *int, delete_old bool) error {
 	envInput := struct {
-		NumDumps  string
-		DeleteOld string
-		Kernel    string
-		Initrd    string
-	}{"", "0", kdumpKernel, kdumpInitrd}
+		NumDumps     string
+		DeleteOld    string
+		SecureDelete string
+		Kernel       string
+		Initrd       string
+	}{"", "0", "0", kdumpKernel, kdumpInitrd}
 	if numfile != (*int)(nil) {
 		envInput.NumDumps = strconv.FormatInt(int64(*numfile), 10)
 	}
 	if delete_old {
 		envInput.DeleteOld = "1"
 	}
+	if SecureDeleteEnabled() {
+		envInput.SecureDelete = "1"
+	}
 	var envbuf bytes.Buffer
 	err := envFileTemplate.Execute(&envbuf, &envInput)
 	if err != nil {
@@ -174,12 +195,14 @@ func Enable(numdumps *int, delete_old bool) error {
 	// If Kdump is already loaded no need to restart.
 	if GetKDumpState() == KDumpReady {
 		log.Ilog.Printf("No need to restart Kernel Crash Dump Service")
+		go updateSymbolArchive()
 		return nil
 	}
 	if err = startSystemdService(kdumpLoadService); err != nil {
 		log.Elog.Printf("Failed to start kdumpLoadService:%s", err.Error())
 		return err
 	}
+	go updateSymbolArchive()
 	return nil
 }
 
@@ -287,42 +310,56 @@ func IsRebootNeeded() bool {
 }
 
 func isCrashDir(dentry os.FileInfo) bool {
+	return crashDirError(dentry) == ""
+}
+
+// Check if a crash directory entry holds a saved crash dump. Returns why
+// not, or "" for a crash dump.
+func crashDirError(dentry os.FileInfo) string {
 	if !dentry.IsDir() {
-		return false
+		return "not a crash dump directory"
 	}
 	name := dentry.Name()
 	if len(name) != 12 { // YYYYYMMDDhhmm
-		return false
+		return "invalid crash dump directory name"
 	}
 	year, err := strconv.ParseUint(name[:4], 10, 0)
 	if err != nil || year < 1970 { // Start of epoch
-		return false
+		return "invalid crash dump directory name"
 	}
 	month, err := strconv.ParseUint(name[4:6], 10, 0)
 	if err != nil || month > 12 {
-		return false
+		return "invalid crash dump directory name"
 	}
-	day, err := strconv.ParseUint(name[4:6], 10, 0)
+	day, err := strconv.ParseUint(name[6:8], 10, 0)
 	if err != nil || day > 31 {
-		return false
+		return "invalid crash dump directory name"
 	}
 	_, err = GetCrashSize(name)
+	if os.IsNotExist(err) {
+		return "no crash dump file"
+	}
 	if err != nil {
-		return false
+		return err.Error()
 	}
-	dumpfile := fmt.Sprintf("%s/%s/dump.%s", kdumpCrashDir, name, name)
-	out, err := exec.Command("/usr/bin/file", "--brief", dumpfile).Output()
+	dumpfile, encrypted := CrashDumpFile(name)
+	if encrypted {
+		return ""
+	}
+	// Incomplete dumps are listed too, as long as the format is known
+	f, err := os.Open(dumpfile)
 	if err != nil {
-		return false
+		return err.Error()
 	}
-	if bytes.HasPrefix(out, []byte("Kdump compressed dump")) {
-		return true
+	defer f.Close()
+	if dumpFormat(f) == DumpFormatUnknown {
+		return "unknown crash dump format"
 	}
-	return false
+	return ""
 }
 
 func GetCrashSize(name string) (int64, error) {
-	dumpfile := fmt.Sprintf("%s/%s/dump.%s", kdumpCrashDir, name, name)
+	dumpfile, _ := CrashDumpFile(name)
 	dump_fi, err := os.Stat(dumpfile)
 	if err != nil {
 		return 0, err
@@ -337,30 +374,53 @@ func GetCrashSize(name string) (int64, error) {
 }
 
 func GetCrashFiles() (string, []os.FileInfo) {
-	crashfiles := make([]os.FileInfo, 0)
-	dentries, err := ioutil.ReadDir(kdumpCrashDir)
-	if err != nil {
-		return kdumpCrashDir, crashfiles
-	}
-	for _, dentry := range dentries {
-		if isCrashDir(dentry) {
-			crashfiles = append(crashfiles, dentry)
-		}
+	entries := catalogEntries()
+	crashfiles := make([]os.FileInfo, len(entries))
+	for i, e := range entries {
+		crashfiles[i] = e.fi
 	}
-	sort.SliceStable(crashfiles, func(i, j int) bool {
-		ni, _ := strconv.ParseUint(crashfiles[i].Name(), 10, 0)
-		nj, _ := strconv.ParseUint(crashfiles[j].Name(), 10, 0)
-		return nj < ni
-	})
 	return kdumpCrashDir, crashfiles
 }
 
-// Get Kdump dmesg file from Crash Dump Name
-func GetCrashDMsg(crashdump os.FileInfo) string {
-	dname := crashdump.Name()
+// Get Kdump dmesg file from Crash Dump Name. If the dmesg file is missing
+// or truncated, the kernel log is extracted from the crash dump itself.
+// Also returns where the kernel log came from. The kernel log is withheld
+// if the encryption policy does not allow it in plaintext.
+func GetCrashDMsg(crashdump os.FileInfo) (string, string) {
+	if !DMesgAllowed() {
+		return "", DMesgSourceEncrypted
+	}
+	return readCrashDMsg(crashdump.Name())
+}
+
+func readCrashDMsg(dname string) (string, string) {
 	fname := fmt.Sprintf("%s/%s/dmesg.%s", kdumpCrashDir, dname, dname)
 	dmesg, _ := ioutil.ReadFile(fname)
-	return string(dmesg)
+	if len(dmesg) != 0 && dmesg[len(dmesg)-1] == '\n' {
+		return string(dmesg), DMesgSourceFile
+	}
+
+	dumpfile, encrypted := CrashDumpFile(dname)
+	if encrypted {
+		if len(dmesg) != 0 {
+			return string(dmesg), DMesgSourceFile
+		}
+		if _, enc := encryptedFile(fname); enc {
+			return "", DMesgSourceEncrypted
+		}
+		return "", DMesgSourceNone
+	}
+	extracted, err := ExtractDMesg(dumpfile)
+	if err != nil {
+		log.Wlog.Printf("Extract dmesg from %s: %s", dumpfile, err)
+	}
+	if len(extracted) > len(dmesg) {
+		return extracted, DMesgSourceVMCore
+	}
+	if len(dmesg) != 0 {
+		return string(dmesg), DMesgSourceFile
+	}
+	return "", DMesgSourceNone
 }
 
 func DelCrashDump(crashdump os.FileInfo) error {
@@ -369,14 +429,35 @@ func DelCrashDump(crashdump os.FileInfo) error {
 		log.Ilog.Printf("DelCrashdump: %s\n", err)
 		return err
 	}
+	forgetCrashDump(crashdump.Name())
 	return nil
 }
 
+// Drop cached information about a deleted crash dump
+func forgetCrashDump(name string) {
+	invalidateCatalog()
+	vmcoreInfoCache.Lock()
+	delete(vmcoreInfoCache.entries, name)
+	vmcoreInfoCache.Unlock()
+	analysisCache.Lock()
+	delete(analysisCache.entries, name)
+	analysisCache.Unlock()
+	dmesgLevelsCache.Lock()
+	delete(dmesgLevelsCache.entries, name)
+	dmesgLevelsCache.Unlock()
+	dumpCheckCache.Lock()
+	delete(dumpCheckCache.entries, name)
+	dumpCheckCache.Unlock()
+	knownIssues.Lock()
+	delete(knownIssues.matches, name)
+	knownIssues.Unlock()
+}
+
 func LastBootCrashed() bool {
 	return lastBootCrashStatus != ""
 }
 
-func getLastBootCrashStatus() (string) {
+func getLastBootCrashStatus() (string, string) {
 	read_status := func(dname string) string {
 		fname := fmt.Sprintf("%s/%s", dname, kdumpLastBootFile)
 		if st, err := ioutil.ReadFile(fname); err == nil && len(st) != 0 {
@@ -399,9 +480,12 @@ func getLastBootCrashStatus() (string) {
 			continue
 		}
 		logLastBootCrashStatus(status, ts)
-		return status
+		if status == "success" {
+			return status, ts
+		}
+		return status, ""
 	}
-	return ""
+	return "", ""
 }
 
 func logLastBootCrashStatus(status string, ts string) {
@@ -418,7 +502,7 @@ func logLastBootCrashStatus(status string, ts string) {
 	case "error":
 		log.Elog.Printf("%s Error while capturing kernel crash dump.", msg)
 	default:
-		log.Elog.Printf("%s Kernel crash dump status is \"%s\".", status)
+		log.Elog.Printf("%s Kernel crash dump status is \"%s\".", msg, status)
 	}
 }
 
@@ -439,7 +523,7 @@ func safeWriteFile(name string, data []byte) error {
 	if err := tmpf.Close(); err != nil {
 		return err
 	}
-	if err := os.Rename(tmpname, kdumpEnvFile); err != nil {
+	if err := os.Rename(tmpname, name); err != nil {
 		return err
 	}
 	return nil
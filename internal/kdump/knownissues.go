@@ -0,0 +1,153 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+)
+
+const knownIssuesFile = "/config/kdump/known-issues.json"
+
+// A known kernel problem and its remediation. A crash dump matches if its
+// signature matches the Signature glob pattern and its kernel log matches
+// the DMesgPattern regular expression. Empty patterns are ignored, but at
+// least one must be given.
+type KnownIssue struct {
+	BugID        string `json:"bug-id"`
+	Title        string `json:"title"`
+	Advice       string `json:"advice,omitempty"`
+	Signature    string `json:"signature,omitempty"`
+	DMesgPattern string `json:"dmesg-pattern,omitempty"`
+	dmesgRe      *regexp.Regexp
+}
+
+// Known issue matched by a crash dump, nil if none, and the kernel log it
+// was matched against
+type knownIssueMatch struct {
+	stamp dmesgStamp
+	issue *KnownIssue
+}
+
+// The known issues database. gen counts the loads, so matches against an
+// older database are not kept.
+var knownIssues = struct {
+	sync.Mutex
+	loaded  bool
+	gen     uint64
+	issues  []*KnownIssue
+	matches map[string]knownIssueMatch
+}{matches: make(map[string]knownIssueMatch)}
+
+func readKnownIssues(fname string) ([]*KnownIssue, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	issues := make([]*KnownIssue, 0)
+	if err := json.Unmarshal(buf, &issues); err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	for i, ki := range issues {
+		if ki.BugID == "" {
+			return nil, fmt.Errorf("%s: entry %d: missing bug-id", fname, i)
+		}
+		if ki.Signature == "" && ki.DMesgPattern == "" {
+			return nil, fmt.Errorf("%s: %s: no signature or dmesg-pattern", fname, ki.BugID)
+		}
+		if _, err := path.Match(ki.Signature, ""); err != nil {
+			return nil, fmt.Errorf("%s: %s: signature: %s", fname, ki.BugID, err)
+		}
+		if ki.DMesgPattern != "" {
+			if ki.dmesgRe, err = regexp.Compile(ki.DMesgPattern); err != nil {
+				return nil, fmt.Errorf("%s: %s: dmesg-pattern: %s", fname, ki.BugID, err)
+			}
+		}
+	}
+	return issues, nil
+}
+
+// (Re)load the known issues database and drop all previous matches.
+// Returns the number of known issues.
+func LoadKnownIssues() (int, error) {
+	issues, err := readKnownIssues(knownIssuesFile)
+	knownIssues.Lock()
+	defer knownIssues.Unlock()
+	knownIssues.loaded = true
+	knownIssues.gen++
+	knownIssues.matches = make(map[string]knownIssueMatch)
+	if err != nil {
+		knownIssues.issues = nil
+		return 0, err
+	}
+	knownIssues.issues = issues
+	return len(issues), nil
+}
+
+func (ki *KnownIssue) matches(sig string, dmesg func() string) bool {
+	if ki.Signature != "" {
+		if ok, _ := path.Match(ki.Signature, sig); !ok || sig == "" {
+			return false
+		}
+	}
+	if ki.dmesgRe != nil && !ki.dmesgRe.MatchString(dmesg()) {
+		return false
+	}
+	return true
+}
+
+// Find the first known issue that matches a crash dump
+func MatchKnownIssue(crashdump os.FileInfo) *KnownIssue {
+	knownIssues.Lock()
+	loaded := knownIssues.loaded
+	knownIssues.Unlock()
+	if !loaded {
+		if _, err := LoadKnownIssues(); err != nil {
+			log.Elog.Println("Known issues:", err)
+		}
+	}
+
+	name := crashdump.Name()
+	stamp := crashDMesgStamp(name)
+	knownIssues.Lock()
+	m, ok := knownIssues.matches[name]
+	issues := knownIssues.issues
+	gen := knownIssues.gen
+	knownIssues.Unlock()
+	if ok && m.stamp == stamp {
+		return m.issue
+	}
+
+	sig := GetCrashSignature(crashdump)
+	// The kernel log is read once, and only if a pattern needs it
+	var dmesgText *string
+	dmesg := func() string {
+		if dmesgText == nil {
+			d, _ := GetCrashDMsg(crashdump)
+			dmesgText = &d
+		}
+		return *dmesgText
+	}
+	var ki *KnownIssue
+	for _, issue := range issues {
+		if issue.matches(sig, dmesg) {
+			ki = issue
+			break
+		}
+	}
+	knownIssues.Lock()
+	if knownIssues.gen == gen {
+		knownIssues.matches[name] = knownIssueMatch{stamp, ki}
+	}
+	knownIssues.Unlock()
+	return ki
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Integrity of the files of a crash dump against its manifest
+const (
+	IntegrityNone       = "none" // no manifest yet
+	IntegrityUnverified = "unverified"
+	IntegrityOK         = "ok"
+	IntegrityMismatch   = "mismatch"
+	IntegrityMissing    = "missing"
+)
+
+// SHA-256 of a file of the crash directory, as recorded in the manifest
+type ManifestEntry struct {
+	File   string
+	SHA256 string
+}
+
+// Result of verifying one file of a crash directory
+type FileIntegrity struct {
+	File     string
+	Status   string
+	Expected string
+	Actual   string
+}
+
+var (
+	manifestMu   sync.Mutex
+	manifestJobs = struct {
+		sync.Mutex
+		pending map[string]bool
+	}{pending: make(map[string]bool)}
+)
+
+// The manifest is in sha256sum format so it can be checked with
+// "sha256sum -c" after copying a crash directory to another system.
+func manifestFile(name string) string {
+	return fmt.Sprintf("%s/%s/manifest.%s", kdumpCrashDir, name, name)
+}
+
+// Files of a crash directory covered by the manifest. The crash dump
+// metadata is left out as it changes, for example on each verification.
+func manifestFiles(name string) []string {
+	files := make([]string, 0)
+	names := append(crashDumpNames(name), fmt.Sprintf("dmesg.%s", name),
+		fmt.Sprintf("modules.%s", name))
+	for _, fname := range names {
+		files = append(files, fname)
+		for _, sfx := range encryptedSuffixes {
+			files = append(files, fname+sfx)
+		}
+	}
+	return files
+}
+
+func fileSHA256(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Read the manifest of a crash directory
+func ReadManifest(name string) ([]ManifestEntry, error) {
+	f, err := os.Open(manifestFile(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]ManifestEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		entries = append(entries, ManifestEntry{
+			File:   strings.TrimPrefix(fields[1], "*"),
+			SHA256: fields[0],
+		})
+	}
+	return entries, scanner.Err()
+}
+
+func writeManifest(name string, entries []ManifestEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].File < entries[j].File
+	})
+	var sb strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&sb, "%s  %s\n", e.SHA256, e.File)
+	}
+	return safeWriteFile(manifestFile(name), []byte(sb.String()))
+}
+
+func crashDirFile(name, file string) string {
+	return fmt.Sprintf("%s/%s/%s", kdumpCrashDir, name, file)
+}
+
+// Write the manifest of a crash directory. The vmcore is hashed without
+// holding the manifest lock as this may take a while.
+func createManifest(name string) error {
+	files := manifestFiles(name)
+	entries := make([]ManifestEntry, 0, len(files))
+	for _, file := range files {
+		sum, err := fileSHA256(crashDirFile(name, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ManifestEntry{file, sum})
+	}
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	if _, err := os.Stat(manifestFile(name)); err == nil {
+		return nil
+	}
+	log.Ilog.Printf("Writing checksum manifest for crash dump %s", name)
+	return writeManifest(name, entries)
+}
+
+// Claim writing the manifest of a crash directory that has none
+func claimManifest(name string) bool {
+	if _, err := os.Stat(manifestFile(name)); err == nil {
+		return false
+	}
+	manifestJobs.Lock()
+	defer manifestJobs.Unlock()
+	if manifestJobs.pending[name] {
+		return false
+	}
+	manifestJobs.pending[name] = true
+	return true
+}
+
+func ensureManifest(name string) {
+	if e := encryptionPolicy(); e != nil {
+		if err := encryptCrashDump(e, name); err != nil {
+			log.Elog.Printf("Encrypt crash dump %s: %s", name, err)
+		}
+	}
+	if err := createManifest(name); err != nil {
+		log.Elog.Printf("Checksum manifest for %s: %s", name, err)
+	}
+	manifestJobs.Lock()
+	delete(manifestJobs.pending, name)
+	manifestJobs.Unlock()
+}
+
+// Start writing the manifest of a newly saved or imported crash directory
+func EnsureManifest(name string) {
+	if claimManifest(name) {
+		go ensureManifest(name)
+	}
+}
+
+// Start writing the manifests of crash dumps that have none, like those
+// saved by kdump-tools before the service started. They are written one
+// at a time.
+func EnsureManifests() {
+	_, crashdumps := GetCrashFiles()
+	names := make([]string, 0, len(crashdumps))
+	for _, crashdump := range crashdumps {
+		if claimManifest(crashdump.Name()) {
+			names = append(names, crashdump.Name())
+		}
+	}
+	go func() {
+		for _, name := range names {
+			ensureManifest(name)
+		}
+	}()
+}
+
+// Record the new checksum of a file written after the manifest, like the
+// kernel log extracted from the vmcore
+func updateManifestEntry(name, file string) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	entries, err := ReadManifest(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(crashDirFile(name, file))
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range entries {
+		if entries[i].File == file {
+			entries[i].SHA256 = sum
+			found = true
+		}
+	}
+	if !found {
+		entries = append(entries, ManifestEntry{file, sum})
+	}
+	return writeManifest(name, entries)
+}
+
+// Record the checksum of the encrypted version of a file in place of the
+// plaintext file
+func replaceManifestEntry(name, file, newfile string) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	entries, err := ReadManifest(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].File != file {
+			continue
+		}
+		sum, err := fileSHA256(crashDirFile(name, newfile))
+		if err != nil {
+			return err
+		}
+		entries[i] = ManifestEntry{newfile, sum}
+		return writeManifest(name, entries)
+	}
+	return nil
+}
+
+// Check the files of a crash directory against its manifest. The manifest
+// is written first if the crash dump has none yet. The result is kept in
+// the crash dump metadata.
+func VerifyCrashDump(crashdump os.FileInfo) (string, []FileIntegrity, error) {
+	name := crashdump.Name()
+	if _, err := os.Stat(manifestFile(name)); os.IsNotExist(err) {
+		if err := createManifest(name); err != nil {
+			return "", nil, err
+		}
+	}
+	entries, err := ReadManifest(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	status := IntegrityOK
+	res := make([]FileIntegrity, len(entries))
+	for i, e := range entries {
+		res[i] = FileIntegrity{File: e.File, Expected: e.SHA256}
+		sum, err := fileSHA256(crashDirFile(name, e.File))
+		switch {
+		case os.IsNotExist(err):
+			res[i].Status = IntegrityMissing
+			status = IntegrityMissing
+		case err != nil:
+			return "", nil, err
+		case sum != e.SHA256:
+			res[i].Status = IntegrityMismatch
+			res[i].Actual = sum
+			if status == IntegrityOK {
+				status = IntegrityMismatch
+			}
+		default:
+			res[i].Status = IntegrityOK
+			res[i].Actual = sum
+		}
+	}
+
+	_, err = UpdateDumpMeta(name, func(meta *DumpMeta) {
+		meta.Integrity = status
+		meta.Verified = time.Now().UTC().Format(time.RFC3339)
+	})
+	if err != nil {
+		log.Wlog.Printf("Save verification status of %s: %s", name, err)
+	}
+	return status, res, nil
+}
+
+// Get the last verification status of a crash dump and when it was
+// verified
+func GetCrashIntegrity(crashdump os.FileInfo) (string, string) {
+	name := crashdump.Name()
+	if _, err := os.Stat(manifestFile(name)); err != nil {
+		return IntegrityNone, ""
+	}
+	meta, err := ReadDumpMeta(name)
+	if err != nil || meta.Integrity == "" {
+		return IntegrityUnverified, ""
+	}
+	return meta.Integrity, meta.Verified
+}
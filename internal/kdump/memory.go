@@ -0,0 +1,338 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"compress/zlib"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+const (
+	dumpDHCompressedZlib   = 0x1
+	dumpDHCompressedLZO    = 0x2
+	dumpDHCompressedSnappy = 0x4
+	dumpDHIncomplete       = 0x8
+	dumpDHCompressedZstd   = 0x20
+
+	pageDescSize = 24
+
+	x86StartKernelMap = 0xffffffff80000000
+	x86PteMask        = 0x000ffffffffff000
+	x86PtePresent     = 0x1
+	x86PtePSE         = 0x80
+)
+
+// Physical memory of a crash dump
+type physReader interface {
+	readPhys(paddr uint64, buf []byte) error
+}
+
+// Kernel virtual memory of a crash dump
+type dumpMemory struct {
+	f    *os.File
+	phys physReader
+	vmi  *VMCoreInfo
+	// ELF vmcores map most of the kernel virtual address space directly
+	loads []*elf.Prog
+	// x86_64 page table translation
+	physBase uint64
+	topPgt   uint64
+	levels   int
+}
+
+// Open a crash dump for reading kernel memory
+func openDumpMemory(fname string) (*dumpMemory, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	m := &dumpMemory{f: f}
+	switch dumpFormat(f) {
+	case DumpFormatKdump:
+		err = m.initDiskDump()
+	case DumpFormatELF:
+		err = m.initELF()
+	default:
+		err = fmt.Errorf("%s: unknown crash dump format", fname)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	m.initPageTables()
+	return m, nil
+}
+
+func (m *dumpMemory) Close() error {
+	return m.f.Close()
+}
+
+func (m *dumpMemory) initDiskDump() error {
+	h, err := readDiskDumpHeader(m.f)
+	if err != nil {
+		return err
+	}
+	if m.vmi, err = diskDumpVMCoreInfo(m.f); err != nil {
+		return err
+	}
+	dd, err := newDiskDumpPhys(m.f, h)
+	if err != nil {
+		return err
+	}
+	m.phys = dd
+	m.physBase = h.PhysBase
+	return nil
+}
+
+func (m *dumpMemory) initELF() error {
+	ef, err := elf.NewFile(m.f)
+	if err != nil {
+		return err
+	}
+	if m.vmi, err = elfVMCoreInfo(m.f); err != nil {
+		return err
+	}
+	for _, prog := range ef.Progs {
+		if prog.Type == elf.PT_LOAD {
+			m.loads = append(m.loads, prog)
+		}
+	}
+	m.phys = elfPhys(m.loads)
+	return nil
+}
+
+// Set up page table translation for x86_64 dumps. This is needed for
+// kdump-compressed dumps which only contain physical pages.
+func (m *dumpMemory) initPageTables() {
+	if pb, ok := m.vmi.Number("phys_base"); ok {
+		m.physBase = pb
+	}
+	pgt, ok := m.vmi.Symbol("init_top_pgt")
+	if !ok {
+		pgt, ok = m.vmi.Symbol("init_level4_pgt")
+	}
+	if !ok {
+		return
+	}
+	m.topPgt = pgt - x86StartKernelMap + m.physBase
+	m.levels = 4
+	if l5, ok := m.vmi.Number("pgtable_l5_enabled"); ok && l5 != 0 {
+		m.levels = 5
+	}
+}
+
+// Translate a kernel virtual address using the x86_64 page tables
+func (m *dumpMemory) virtToPhys(vaddr uint64) (uint64, error) {
+	if m.levels == 0 {
+		return 0, errors.New("virtual address translation not supported for this dump")
+	}
+	table := m.topPgt
+	var entry [8]byte
+	for level := m.levels; level > 0; level-- {
+		shift := uint(12 + 9*(level-1))
+		index := (vaddr >> shift) & 0x1ff
+		if err := m.phys.readPhys(table+index*8, entry[:]); err != nil {
+			return 0, err
+		}
+		pte := binary.LittleEndian.Uint64(entry[:])
+		if pte&x86PtePresent == 0 {
+			return 0, fmt.Errorf("virtual address %#x not mapped", vaddr)
+		}
+		// 1G and 2M pages
+		if (level == 2 || level == 3) && pte&x86PtePSE != 0 {
+			mask := uint64(1)<<shift - 1
+			return (pte & x86PteMask &^ mask) | (vaddr & mask), nil
+		}
+		table = pte & x86PteMask
+	}
+	return table | (vaddr & 0xfff), nil
+}
+
+func (m *dumpMemory) readVirt(vaddr uint64, buf []byte) error {
+	for len(buf) > 0 {
+		n := len(buf)
+		if pgoff := int(vaddr & 0xfff); n > 0x1000-pgoff {
+			n = 0x1000 - pgoff
+		}
+		if err := m.readVirtPage(vaddr, buf[:n]); err != nil {
+			return err
+		}
+		buf = buf[n:]
+		vaddr += uint64(n)
+	}
+	return nil
+}
+
+func (m *dumpMemory) readVirtPage(vaddr uint64, buf []byte) error {
+	for _, p := range m.loads {
+		if vaddr >= p.Vaddr && vaddr+uint64(len(buf)) <= p.Vaddr+p.Filesz {
+			_, err := p.ReadAt(buf, int64(vaddr-p.Vaddr))
+			return err
+		}
+	}
+	paddr, err := m.virtToPhys(vaddr)
+	if err != nil {
+		return err
+	}
+	return m.phys.readPhys(paddr, buf)
+}
+
+func (m *dumpMemory) readU16(vaddr uint64) (uint16, error) {
+	var b [2]byte
+	err := m.readVirt(vaddr, b[:])
+	return binary.LittleEndian.Uint16(b[:]), err
+}
+
+func (m *dumpMemory) readU32(vaddr uint64) (uint32, error) {
+	var b [4]byte
+	err := m.readVirt(vaddr, b[:])
+	return binary.LittleEndian.Uint32(b[:]), err
+}
+
+func (m *dumpMemory) readU64(vaddr uint64) (uint64, error) {
+	var b [8]byte
+	err := m.readVirt(vaddr, b[:])
+	return binary.LittleEndian.Uint64(b[:]), err
+}
+
+type elfPhys []*elf.Prog
+
+func (e elfPhys) readPhys(paddr uint64, buf []byte) error {
+	for _, p := range e {
+		if paddr >= p.Paddr && paddr+uint64(len(buf)) <= p.Paddr+p.Filesz {
+			_, err := p.ReadAt(buf, int64(paddr-p.Paddr))
+			return err
+		}
+	}
+	return fmt.Errorf("physical address %#x not in dump", paddr)
+}
+
+// Page access for makedumpfile kdump-compressed format
+type diskDumpPhys struct {
+	r         io.ReaderAt
+	h         *diskDumpHeader
+	bitmap    []byte // 2nd bitmap: pages present in the dump
+	counts    []uint64
+	descStart int64
+	lastPfn   uint64
+	lastPage  []byte
+}
+
+const bitmapChunk = 4096
+
+func newDiskDumpPhys(r io.ReaderAt, h *diskDumpHeader) (*diskDumpPhys, error) {
+	bs := int64(h.BlockSize)
+	bmlen := int64(h.BitmapBlocks) * bs / 2
+	bmoff := (1+int64(h.SubHdrSize))*bs + bmlen
+	dd := &diskDumpPhys{
+		r:         r,
+		h:         h,
+		bitmap:    make([]byte, bmlen),
+		descStart: (1 + int64(h.SubHdrSize) + int64(h.BitmapBlocks)) * bs,
+		lastPfn:   ^uint64(0),
+	}
+	if _, err := r.ReadAt(dd.bitmap, bmoff); err != nil {
+		return nil, fmt.Errorf("kdump bitmap: %s", err)
+	}
+	// Running count of dumped pages at the start of each bitmap chunk
+	dd.counts = make([]uint64, len(dd.bitmap)/bitmapChunk+1)
+	var n uint64
+	for i, b := range dd.bitmap {
+		if i%bitmapChunk == 0 {
+			dd.counts[i/bitmapChunk] = n
+		}
+		n += uint64(bits.OnesCount8(b))
+	}
+	return dd, nil
+}
+
+func (dd *diskDumpPhys) isDumped(pfn uint64) bool {
+	if pfn/8 >= uint64(len(dd.bitmap)) {
+		return false
+	}
+	return dd.bitmap[pfn/8]&(1<<(pfn%8)) != 0
+}
+
+// Index of the page descriptor of a dumped page
+func (dd *diskDumpPhys) descIndex(pfn uint64) uint64 {
+	byteIdx := pfn / 8
+	chunk := byteIdx / bitmapChunk
+	n := dd.counts[chunk]
+	for i := chunk * bitmapChunk; i < byteIdx; i++ {
+		n += uint64(bits.OnesCount8(dd.bitmap[i]))
+	}
+	mask := byte(1)<<(pfn%8) - 1
+	return n + uint64(bits.OnesCount8(dd.bitmap[byteIdx]&mask))
+}
+
+func (dd *diskDumpPhys) readPage(pfn uint64) ([]byte, error) {
+	if pfn == dd.lastPfn {
+		return dd.lastPage, nil
+	}
+	bs := int(dd.h.BlockSize)
+	if !dd.isDumped(pfn) {
+		// Excluded pages (zero, free, cache etc.) read as zero
+		if pfn >= dd.h.MaxMapNr {
+			return nil, fmt.Errorf("page frame %#x beyond end of memory", pfn)
+		}
+		return make([]byte, bs), nil
+	}
+
+	var desc [pageDescSize]byte
+	descoff := dd.descStart + int64(dd.descIndex(pfn))*pageDescSize
+	if _, err := dd.r.ReadAt(desc[:], descoff); err != nil {
+		return nil, fmt.Errorf("page descriptor for %#x: %s", pfn, err)
+	}
+	le := binary.LittleEndian
+	offset := int64(le.Uint64(desc[0:]))
+	size := le.Uint32(desc[8:])
+	flags := le.Uint32(desc[12:])
+	if size == 0 || size > uint32(bs) {
+		return nil, fmt.Errorf("page %#x: invalid size %d", pfn, size)
+	}
+	data := make([]byte, size)
+	if _, err := dd.r.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("page %#x: %s", pfn, err)
+	}
+
+	page := make([]byte, bs)
+	switch {
+	case flags&dumpDHCompressedZlib != 0:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("page %#x: %s", pfn, err)
+		}
+		if _, err := io.ReadFull(zr, page); err != nil {
+			return nil, fmt.Errorf("page %#x: %s", pfn, err)
+		}
+	case flags&(dumpDHCompressedLZO|dumpDHCompressedSnappy|dumpDHCompressedZstd) != 0:
+		return nil, fmt.Errorf("page %#x: unsupported compression %#x", pfn, flags)
+	case size == uint32(bs):
+		copy(page, data)
+	default:
+		return nil, fmt.Errorf("page %#x: short uncompressed page", pfn)
+	}
+	dd.lastPfn, dd.lastPage = pfn, page
+	return page, nil
+}
+
+func (dd *diskDumpPhys) readPhys(paddr uint64, buf []byte) error {
+	bs := uint64(dd.h.BlockSize)
+	for len(buf) > 0 {
+		page, err := dd.readPage(paddr / bs)
+		if err != nil {
+			return err
+		}
+		n := copy(buf, page[paddr%bs:])
+		buf = buf[n:]
+		paddr += uint64(n)
+	}
+	return nil
+}
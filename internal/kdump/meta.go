@@ -0,0 +1,92 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Information about a crash dump kept in its crash directory
+type DumpMeta struct {
+	Signature string `json:"signature,omitempty"`
+	Integrity string `json:"integrity,omitempty"`
+	Verified  string `json:"verified,omitempty"`
+	// Saved when the crash dump is encrypted or salvaged
+	VMCoreInfo *VMCoreInfo `json:"vmcoreinfo,omitempty"`
+	Incomplete string      `json:"incomplete,omitempty"`
+	// Set by the operator
+	Notes  string `json:"notes,omitempty"`
+	Pinned bool   `json:"pinned,omitempty"`
+	// Set by import-crash-dump
+	Imported *ImportSource `json:"imported,omitempty"`
+}
+
+var metaMu sync.Mutex
+
+func dumpMetaFile(name string) string {
+	return fmt.Sprintf("%s/%s/meta.%s", kdumpCrashDir, name, name)
+}
+
+// Read the metadata of a crash dump. A missing metadata file is not an
+// error, the crash dump just has no metadata yet.
+func ReadDumpMeta(name string) (*DumpMeta, error) {
+	meta := &DumpMeta{}
+	buf, err := ioutil.ReadFile(dumpMetaFile(name))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(buf, meta); err != nil {
+		return meta, fmt.Errorf("%s: %s", dumpMetaFile(name), err)
+	}
+	return meta, nil
+}
+
+func writeDumpMeta(name string, meta *DumpMeta) error {
+	buf, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return safeWriteFile(dumpMetaFile(name), append(buf, '\n'))
+}
+
+// Read, modify and write back the metadata of a crash dump
+func UpdateDumpMeta(name string, update func(*DumpMeta)) (*DumpMeta, error) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	meta, err := ReadDumpMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	update(meta)
+	return meta, writeDumpMeta(name, meta)
+}
+
+// Protect a crash dump from deletion of all crash dumps and from automatic
+// deletion of old crash dumps, or remove the protection
+func SetPinned(crashdump os.FileInfo, pinned bool) error {
+	_, err := UpdateDumpMeta(crashdump.Name(), func(m *DumpMeta) {
+		m.Pinned = pinned
+	})
+	return err
+}
+
+// Attach notes to a crash dump, like a ticket number or owner. Empty notes
+// remove them.
+func SetNotes(crashdump os.FileInfo, notes string) error {
+	_, err := UpdateDumpMeta(crashdump.Name(), func(m *DumpMeta) {
+		m.Notes = notes
+	})
+	return err
+}
+
+func IsPinned(crashdump os.FileInfo) bool {
+	meta, err := ReadDumpMeta(crashdump.Name())
+	return err == nil && meta.Pinned
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Temporary files younger than this may still be in use
+const tempFileMinAge = 10 * time.Minute
+
+// Files in the crash directory used by the crash dump service
+var crashDirFiles = map[string]bool{
+	kdumpSavecoreStatus: true,
+	kdumpLastBootFile:   true,
+	kdumpModulesFile:    true,
+	"kexec_cmd":         true,
+	"symbols":           true,
+}
+
+// Temporary files from encryption, and from safeWriteFile and copyFile
+// which append random digits to the name of the file being written
+var tempFileRe = regexp.MustCompile(`^(?:.+\.tmp|` +
+	`(?:dmesg|meta|manifest|crash-commands|modules)\.\d{12}\d+|` +
+	`report\.\d{12}\.(?:json|md|html)\d+)$`)
+
+// Entry in the crash directory that is not a saved crash dump. Entries
+// holding the details of a crash are kept by cleanup.
+type OrphanEntry struct {
+	Path   string
+	Size   int64
+	Reason string
+	Kept   bool
+}
+
+// Total size of the regular files under a path
+func entrySize(p string) int64 {
+	var total int64
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func isWiping(dname string) bool {
+	if !strings.HasSuffix(dname, wipeDirSuffix) {
+		return false
+	}
+	wipes.Lock()
+	defer wipes.Unlock()
+	_, ok := wipes.entries[strings.TrimSuffix(dname, wipeDirSuffix)]
+	return ok
+}
+
+// Orphaned entries found by a scan of the crash directory, and when the
+// next temporary file becomes stale, which makes the scan out of date
+type orphanScan struct {
+	entries []OrphanEntry
+	expire  time.Time
+}
+
+func newOrphanScan() *orphanScan {
+	return &orphanScan{entries: make([]OrphanEntry, 0)}
+}
+
+// Check for a temporary file. Stale ones are orphaned, younger ones may
+// still be in use and are skipped.
+func (s *orphanScan) tempFile(d os.FileInfo, fname string) bool {
+	if !d.Mode().IsRegular() || !tempFileRe.MatchString(d.Name()) {
+		return false
+	}
+	stale := d.ModTime().Add(tempFileMinAge)
+	if time.Now().Before(stale) {
+		if s.expire.IsZero() || stale.Before(s.expire) {
+			s.expire = stale
+		}
+		return true
+	}
+	s.entries = append(s.entries, OrphanEntry{fname, d.Size(), "leftover temporary file", false})
+	return true
+}
+
+// Find leftover temporary files in a crash dump directory
+func (s *orphanScan) crashDir(name string) {
+	dir := fmt.Sprintf("%s/%s", kdumpCrashDir, name)
+	dentries, _ := ioutil.ReadDir(dir)
+	for _, d := range dentries {
+		s.tempFile(d, fmt.Sprintf("%s/%s", dir, d.Name()))
+	}
+}
+
+// Check an entry of the crash directory that is not a saved crash dump.
+// Files used by the crash dump service are skipped.
+func (s *orphanScan) entry(d os.FileInfo, reason string) {
+	if crashDirFiles[d.Name()] || isWiping(d.Name()) || isImporting(d.Name()) {
+		return
+	}
+	fname := fmt.Sprintf("%s/%s", kdumpCrashDir, d.Name())
+	if s.tempFile(d, fname) {
+		return
+	}
+	if d.IsDir() {
+		if contents, _ := ioutil.ReadDir(fname); len(contents) == 0 {
+			reason = "empty directory"
+		} else if kept := crashDetailFiles(d.Name()); len(kept) != 0 {
+			reason = fmt.Sprintf("%s, crash details kept: %s", reason, strings.Join(kept, ", "))
+			s.entries = append(s.entries, OrphanEntry{fname, entrySize(fname), reason, true})
+			return
+		}
+	} else if d.Mode().IsRegular() {
+		reason = "unrecognised file"
+	}
+	s.entries = append(s.entries, OrphanEntry{fname, entrySize(fname), reason, false})
+}
+
+// Find the files of a crash directory, other than the crash dump file,
+// which hold details of the crash: its kernel log, metadata, checksum
+// manifest, module list, crash utility output and reports, encrypted or
+// not. They may be all that is left of a crash.
+func crashDetailFiles(name string) []string {
+	re := regexp.MustCompile(`^(?:dmesg|meta|manifest|modules|crash-commands|report)\.` +
+		regexp.QuoteMeta(name) + `(?:\..+)?$`)
+	res := make([]string, 0)
+	dentries, _ := ioutil.ReadDir(fmt.Sprintf("%s/%s", kdumpCrashDir, name))
+	for _, d := range dentries {
+		if d.Mode().IsRegular() && re.MatchString(d.Name()) && !tempFileRe.MatchString(d.Name()) {
+			res = append(res, d.Name())
+		}
+	}
+	return res
+}
+
+// List the entries in the crash directory that are not saved crash
+// dumps or files used by the crash dump service. They are found by the
+// scan of the crash directory for the catalog.
+func GetOrphanedEntries() []OrphanEntry {
+	return catalogOrphans()
+}
+
+func removeEntry(p string) error {
+	if SecureDeleteEnabled() {
+		filepath.Walk(p, func(fname string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				if err := wipeFile(fname, nil); err != nil {
+					log.Elog.Printf("Secure delete %s: %s", fname, err)
+				}
+			}
+			return nil
+		})
+	}
+	return os.RemoveAll(p)
+}
+
+// Remove orphaned entries from the crash directory, except those holding
+// crash details, which are left for the operator. Returns the entries
+// removed and those kept. With dryrun, only list them.
+func CleanupCrashDir(dryrun bool) ([]OrphanEntry, error) {
+	orphans := GetOrphanedEntries()
+	if dryrun {
+		return orphans, nil
+	}
+	removed := make([]OrphanEntry, 0, len(orphans))
+	for _, o := range orphans {
+		if o.Kept {
+			removed = append(removed, o)
+			continue
+		}
+		log.Ilog.Printf("Removing %s from the crash directory: %s", o.Path, o.Reason)
+		err := removeEntry(o.Path)
+		invalidateCatalog()
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, o)
+	}
+	return removed, nil
+}
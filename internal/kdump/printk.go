@@ -0,0 +1,287 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	maxLogBufSize = 64 << 20
+
+	// printk_ringbuffer descriptor state (kernel/printk/printk_ringbuffer.h)
+	descFlagsShift     = 62
+	descIDMask         = ^uint64(3 << descFlagsShift)
+	descStateCommitted = 1
+	descStateFinalized = 2
+)
+
+// A kernel log message from the printk buffer
+type logRecord struct {
+	TsNsec uint64
+	Level  int
+	Text   string
+}
+
+func (r *logRecord) String() string {
+	return fmt.Sprintf("[%5d.%06d] %s", r.TsNsec/1000000000, r.TsNsec%1000000000/1000, r.Text)
+}
+
+func formatLogRecords(records []logRecord) string {
+	var sb strings.Builder
+	for i := range records {
+		sb.WriteString(records[i].String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// VMCOREINFO values needed to walk the printk buffer
+type vmcoreInfoReader struct {
+	vmi *VMCoreInfo
+	err error
+}
+
+func (v *vmcoreInfoReader) get(kind string, name string) uint64 {
+	var val uint64
+	var ok bool
+	switch kind {
+	case "SYMBOL":
+		val, ok = v.vmi.Symbol(name)
+	case "SIZE":
+		val, ok = v.vmi.Size(name)
+	case "OFFSET":
+		val, ok = v.vmi.Offset(name)
+	}
+	if !ok && v.err == nil {
+		v.err = fmt.Errorf("VMCOREINFO: %s(%s) not found", kind, name)
+	}
+	return val
+}
+
+// Read the kernel log records from a crash dump
+func readLogRecords(m *dumpMemory) ([]logRecord, error) {
+	if _, ok := m.vmi.Symbol("prb"); ok {
+		return readPrintkRingbuffer(m)
+	}
+	if _, ok := m.vmi.Symbol("log_buf"); ok {
+		return readLegacyLogBuf(m)
+	}
+	return nil, errors.New("VMCOREINFO: no printk buffer symbols")
+}
+
+// Walk the variable length record buffer used by kernels before 5.10
+func readLegacyLogBuf(m *dumpMemory) ([]logRecord, error) {
+	v := &vmcoreInfoReader{vmi: m.vmi}
+	logBufSym := v.get("SYMBOL", "log_buf")
+	logBufLenSym := v.get("SYMBOL", "log_buf_len")
+	firstIdxSym := v.get("SYMBOL", "log_first_idx")
+	nextIdxSym := v.get("SYMBOL", "log_next_idx")
+	hdrSize := v.get("SIZE", "printk_log")
+	tsOff := v.get("OFFSET", "printk_log.ts_nsec")
+	lenOff := v.get("OFFSET", "printk_log.len")
+	textLenOff := v.get("OFFSET", "printk_log.text_len")
+	if v.err != nil {
+		return nil, v.err
+	}
+
+	logBuf, err := m.readU64(logBufSym)
+	if err != nil {
+		return nil, err
+	}
+	bufLen, err := m.readU32(logBufLenSym)
+	if err != nil {
+		return nil, err
+	}
+	firstIdx, err := m.readU32(firstIdxSym)
+	if err != nil {
+		return nil, err
+	}
+	nextIdx, err := m.readU32(nextIdxSym)
+	if err != nil {
+		return nil, err
+	}
+	if bufLen == 0 || bufLen > maxLogBufSize {
+		return nil, fmt.Errorf("invalid log_buf_len %d", bufLen)
+	}
+	buf := make([]byte, bufLen)
+	if err := m.readVirt(logBuf, buf); err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	records := make([]logRecord, 0)
+	idx := uint64(firstIdx)
+	for n := uint64(0); idx != uint64(nextIdx) && n < uint64(bufLen)/hdrSize; n++ {
+		if idx+hdrSize > uint64(bufLen) {
+			return records, errors.New("log_buf: record header out of bounds")
+		}
+		hdr := buf[idx:]
+		reclen := uint64(le.Uint16(hdr[lenOff:]))
+		if reclen == 0 {
+			// Wrap around to the start of the buffer
+			idx = 0
+			continue
+		}
+		textLen := uint64(le.Uint16(hdr[textLenOff:]))
+		if idx+hdrSize+textLen > uint64(bufLen) {
+			return records, errors.New("log_buf: record text out of bounds")
+		}
+		records = append(records, logRecord{
+			TsNsec: le.Uint64(hdr[tsOff:]),
+			// facility and flags:5/level:3 follow text_len and dict_len
+			Level: int(hdr[textLenOff+5] >> 5),
+			Text:  string(buf[idx+hdrSize : idx+hdrSize+textLen]),
+		})
+		idx += reclen
+	}
+	return records, nil
+}
+
+// Walk the lockless printk_ringbuffer used since kernel 5.10
+func readPrintkRingbuffer(m *dumpMemory) ([]logRecord, error) {
+	v := &vmcoreInfoReader{vmi: m.vmi}
+	prbSym := v.get("SYMBOL", "prb")
+	descRingOff := v.get("OFFSET", "printk_ringbuffer.desc_ring")
+	textRingOff := v.get("OFFSET", "printk_ringbuffer.text_data_ring")
+	countBitsOff := v.get("OFFSET", "prb_desc_ring.count_bits")
+	descsOff := v.get("OFFSET", "prb_desc_ring.descs")
+	infosOff := v.get("OFFSET", "prb_desc_ring.infos")
+	headIDOff := v.get("OFFSET", "prb_desc_ring.head_id")
+	tailIDOff := v.get("OFFSET", "prb_desc_ring.tail_id")
+	descSize := v.get("SIZE", "prb_desc")
+	stateVarOff := v.get("OFFSET", "prb_desc.state_var")
+	textLposOff := v.get("OFFSET", "prb_desc.text_blk_lpos")
+	beginOff := v.get("OFFSET", "prb_data_blk_lpos.begin")
+	nextOff := v.get("OFFSET", "prb_data_blk_lpos.next")
+	infoSize := v.get("SIZE", "printk_info")
+	tsOff := v.get("OFFSET", "printk_info.ts_nsec")
+	textLenOff := v.get("OFFSET", "printk_info.text_len")
+	sizeBitsOff := v.get("OFFSET", "prb_data_ring.size_bits")
+	dataOff := v.get("OFFSET", "prb_data_ring.data")
+	counterOff := v.get("OFFSET", "atomic_long_t.counter")
+	if v.err != nil {
+		return nil, v.err
+	}
+
+	prb, err := m.readU64(prbSym)
+	if err != nil {
+		return nil, err
+	}
+	descRing := prb + descRingOff
+	textRing := prb + textRingOff
+	countBits, err := m.readU32(descRing + countBitsOff)
+	if err != nil {
+		return nil, err
+	}
+	sizeBits, err := m.readU32(textRing + sizeBitsOff)
+	if err != nil {
+		return nil, err
+	}
+	count := uint64(1) << countBits
+	dataSize := uint64(1) << sizeBits
+	if count*(descSize+infoSize) > maxLogBufSize || dataSize > maxLogBufSize {
+		return nil, fmt.Errorf("invalid printk ringbuffer size %d/%d", count, dataSize)
+	}
+
+	var addrs [5]uint64
+	for i, off := range []uint64{
+		descRing + descsOff,
+		descRing + infosOff,
+		textRing + dataOff,
+		descRing + headIDOff + counterOff,
+		descRing + tailIDOff + counterOff,
+	} {
+		if addrs[i], err = m.readU64(off); err != nil {
+			return nil, err
+		}
+	}
+	headID, tailID := addrs[3], addrs[4]
+
+	descs := make([]byte, count*descSize)
+	infos := make([]byte, count*infoSize)
+	data := make([]byte, dataSize)
+	if err := m.readVirt(addrs[0], descs); err != nil {
+		return nil, err
+	}
+	if err := m.readVirt(addrs[1], infos); err != nil {
+		return nil, err
+	}
+	if err := m.readVirt(addrs[2], data); err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	records := make([]logRecord, 0)
+	for id, n := tailID, uint64(0); n < count; id, n = (id+1)&descIDMask, n+1 {
+		idx := id & (count - 1)
+		desc := descs[idx*descSize:]
+		sv := le.Uint64(desc[stateVarOff+counterOff:])
+		state := sv >> descFlagsShift
+		if sv&descIDMask == id && (state == descStateCommitted || state == descStateFinalized) {
+			begin := le.Uint64(desc[textLposOff+beginOff:])
+			next := le.Uint64(desc[textLposOff+nextOff:])
+			info := infos[idx*infoSize:]
+			if text, ok := ringbufferText(data, sizeBits, begin, next,
+				uint64(le.Uint16(info[textLenOff:]))); ok {
+				records = append(records, logRecord{
+					TsNsec: le.Uint64(info[tsOff:]),
+					// facility and flags:5/level:3 follow text_len
+					Level: int(info[textLenOff+3] >> 5),
+					Text:  text,
+				})
+			}
+		}
+		if id == headID {
+			break
+		}
+	}
+	return records, nil
+}
+
+// Get the text of a record from the printk data ring
+func ringbufferText(data []byte, sizeBits uint32, begin, next, textLen uint64) (string, bool) {
+	const idSize = 8
+	if begin&1 != 0 || next&1 != 0 {
+		// data-less record
+		return "", false
+	}
+	size := uint64(len(data))
+	var start, blkSize uint64
+	switch {
+	case begin>>sizeBits == next>>sizeBits:
+		start, blkSize = begin&(size-1), next-begin
+	case (begin+size)>>sizeBits == next>>sizeBits:
+		// wrapped, the block is at the start of the ring
+		start, blkSize = 0, next&(size-1)
+	default:
+		return "", false
+	}
+	if blkSize < idSize || start+blkSize > size {
+		return "", false
+	}
+	if textLen > blkSize-idSize {
+		textLen = blkSize - idSize
+	}
+	return string(data[start+idSize : start+idSize+textLen]), true
+}
+
+// Extract the kernel log from a crash dump file
+func ExtractDMesg(dumpfile string) (string, error) {
+	m, err := openDumpMemory(dumpfile)
+	if err != nil {
+		return "", err
+	}
+	defer m.Close()
+	records, err := readLogRecords(m)
+	if len(records) == 0 {
+		if err == nil {
+			err = errors.New("kernel log is empty")
+		}
+		return "", err
+	}
+	return formatLogRecords(records), nil
+}
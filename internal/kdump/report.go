@@ -0,0 +1,299 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const reportDMesgLines = 200
+
+// Entry of the crash dump capture status history written by
+// kdump-config.vyatta
+type SavecoreStatus struct {
+	Timestamp string `json:"timestamp"`
+	BootID    string `json:"bootid"`
+	Status    string `json:"status"`
+}
+
+type ReservationReport struct {
+	ReservedMemory  uint64 `json:"reserved-memory"`
+	CrashKernel     string `json:"crashkernel-parameter"`
+	GrubCrashKernel string `json:"grub-crashkernel-mem"`
+	RebootNeeded    bool   `json:"reboot-needed"`
+}
+
+// Everything needed to file a kernel crash with a vendor
+type CrashReport struct {
+	Generated      time.Time         `json:"generated"`
+	Name           string            `json:"name"`
+	Path           string            `json:"path"`
+	Size           int64             `json:"size"`
+	Format         string            `json:"format,omitempty"`
+	KernelRelease  string            `json:"kernel-release,omitempty"`
+	BuildID        string            `json:"build-id,omitempty"`
+	CrashTime      string            `json:"crash-time,omitempty"`
+	PanicCPU       int               `json:"panic-cpu"`
+	Signature      string            `json:"signature,omitempty"`
+	Analysis       *CrashAnalysis    `json:"analysis"`
+	DMesgSource    string            `json:"dmesg-source"`
+	DMesgExcerpt   []string          `json:"dmesg-excerpt"`
+	SavecoreStatus *SavecoreStatus   `json:"savecore-status,omitempty"`
+	Configuration  json.RawMessage   `json:"configuration,omitempty"`
+	KDumpEnv       string            `json:"kdump-tools-env,omitempty"`
+	Reservation    ReservationReport `json:"reservation"`
+	RunningKernel  string            `json:"running-kernel,omitempty"`
+}
+
+// Find the capture status of a crash dump in the status history
+func GetSavecoreStatus(name string) *SavecoreStatus {
+	f, err := os.Open(fmt.Sprintf("%s/%s", kdumpCrashDir, kdumpSavecoreStatus))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var found *SavecoreStatus
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		st := &SavecoreStatus{}
+		n, err := fmt.Sscanf(scanner.Text(), "timestamp=%s bootid=%s status=%s",
+			&st.Timestamp, &st.BootID, &st.Status)
+		if err == nil && n == 3 && st.Timestamp == name {
+			found = st
+		}
+	}
+	return found
+}
+
+// The last lines of the kernel log
+func dmesgExcerpt(dmesg string, n int) []string {
+	lines := strings.Split(strings.TrimRight(dmesg, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// Collect a crash report for a saved crash dump. config is the kernel
+// crash dump configuration in effect, in JSON.
+func GenerateCrashReport(crashdump os.FileInfo, config []byte) *CrashReport {
+	name := crashdump.Name()
+	r := &CrashReport{
+		Generated: time.Now().UTC(),
+		Name:      name,
+		Path:      fmt.Sprintf("%s/%s", kdumpCrashDir, name),
+		PanicCPU:  -1,
+		Reservation: ReservationReport{
+			ReservedMemory:  uint64(CrashKernelMemory),
+			CrashKernel:     CrashKernelParam,
+			GrubCrashKernel: GrubReservedMem(),
+			RebootNeeded:    IsRebootNeeded(),
+		},
+		Configuration:  config,
+		SavecoreStatus: GetSavecoreStatus(name),
+	}
+	r.Size, _ = GetCrashSize(name)
+	if vmi, err := GetVMCoreInfo(name); err == nil {
+		r.Format = vmi.Format
+		r.KernelRelease = vmi.KernelRelease
+		r.BuildID = vmi.BuildID
+		r.PanicCPU = vmi.PanicCPU
+		if vmi.CrashTime != 0 {
+			r.CrashTime = time.Unix(vmi.CrashTime, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	r.Signature = GetCrashSignature(crashdump)
+	r.Analysis = GetCrashAnalysis(crashdump)
+	dmesg, source := GetCrashDMsg(crashdump)
+	r.DMesgSource = source
+	r.DMesgExcerpt = dmesgExcerpt(dmesg, reportDMesgLines)
+	if env, err := ioutil.ReadFile(kdumpEnvFile); err == nil {
+		r.KDumpEnv = string(env)
+	}
+	if buildid, release, err := runningKernel(); err == nil {
+		r.RunningKernel = fmt.Sprintf("%s (build-id %s)", release, buildid)
+	}
+	return r
+}
+
+const reportMarkdown = `# Kernel Crash Report: {{.Name}}
+
+Generated {{.Generated.Format "2006-01-02T15:04:05Z07:00"}}
+
+## Crash Dump
+
+| | |
+|---|---|
+| Path | {{.Path}} |
+| Size | {{.Size}} bytes |
+| Format | {{.Format}} |
+| Kernel release | {{.KernelRelease}} |
+| Build ID | {{.BuildID}} |
+| Crash time | {{.CrashTime}} |
+| Panic CPU | {{if ge .PanicCPU 0}}{{.PanicCPU}}{{else}}unknown{{end}} |
+| Signature | {{.Signature}} |
+{{- with .SavecoreStatus}}
+| Capture status | {{.Status}} (boot {{.BootID}}) |
+{{- end}}
+
+## Panic Analysis
+{{with .Analysis}}
+| | |
+|---|---|
+| Panic message | {{.PanicMessage}} |
+| Oops type | {{.OopsType}} |
+| Instruction pointer | {{.IP}} |
+| Task | {{.Task}}{{if ge .PID 0}} (PID {{.PID}}){{end}} |
+| CPU | {{if ge .CPU 0}}{{.CPU}}{{end}} |
+| Tainted | {{.Tainted}} {{join .TaintFlags ", "}} |
+{{if .CallTrace}}
+Call trace:
+
+` + "```" + `
+{{range .CallTrace}}{{.}}
+{{end}}` + "```" + `
+{{end}}
+{{- if .HardwareHints}}
+Possible hardware errors:
+{{range .HardwareHints}}
+- {{.}}
+{{- end}}
+{{end}}
+{{- end}}
+## Kernel Log ({{.DMesgSource}}, last {{len .DMesgExcerpt}} lines)
+
+` + "```" + `
+{{range .DMesgExcerpt}}{{.}}
+{{end}}` + "```" + `
+
+## Crash Dump Service
+
+| | |
+|---|---|
+| Running kernel | {{.RunningKernel}} |
+| Reserved memory | {{.Reservation.ReservedMemory}} bytes |
+| crashkernel parameter | {{.Reservation.CrashKernel}} |
+| crashkernel in grub | {{.Reservation.GrubCrashKernel}} |
+| Reboot needed | {{.Reservation.RebootNeeded}} |
+
+Configuration:
+
+` + "```" + `
+{{printf "%s" .Configuration}}
+` + "```" + `
+
+kdump-tools settings:
+
+` + "```" + `
+{{.KDumpEnv}}` + "```" + `
+`
+
+const reportHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Kernel Crash Report: {{.Name}}</title></head>
+<body>
+<h1>Kernel Crash Report: {{.Name}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02T15:04:05Z07:00"}}</p>
+<h2>Crash Dump</h2>
+<table>
+<tr><th>Path</th><td>{{.Path}}</td></tr>
+<tr><th>Size</th><td>{{.Size}} bytes</td></tr>
+<tr><th>Format</th><td>{{.Format}}</td></tr>
+<tr><th>Kernel release</th><td>{{.KernelRelease}}</td></tr>
+<tr><th>Build ID</th><td>{{.BuildID}}</td></tr>
+<tr><th>Crash time</th><td>{{.CrashTime}}</td></tr>
+<tr><th>Panic CPU</th><td>{{if ge .PanicCPU 0}}{{.PanicCPU}}{{else}}unknown{{end}}</td></tr>
+<tr><th>Signature</th><td>{{.Signature}}</td></tr>
+{{- with .SavecoreStatus}}
+<tr><th>Capture status</th><td>{{.Status}} (boot {{.BootID}})</td></tr>
+{{- end}}
+</table>
+<h2>Panic Analysis</h2>
+{{- with .Analysis}}
+<table>
+<tr><th>Panic message</th><td>{{.PanicMessage}}</td></tr>
+<tr><th>Oops type</th><td>{{.OopsType}}</td></tr>
+<tr><th>Instruction pointer</th><td>{{.IP}}</td></tr>
+<tr><th>Task</th><td>{{.Task}}{{if ge .PID 0}} (PID {{.PID}}){{end}}</td></tr>
+<tr><th>CPU</th><td>{{if ge .CPU 0}}{{.CPU}}{{end}}</td></tr>
+<tr><th>Tainted</th><td>{{.Tainted}} {{join .TaintFlags ", "}}</td></tr>
+</table>
+{{- if .CallTrace}}
+<h3>Call Trace</h3>
+<pre>{{range .CallTrace}}{{.}}
+{{end}}</pre>
+{{- end}}
+{{- if .HardwareHints}}
+<h3>Possible Hardware Errors</h3>
+<ul>{{range .HardwareHints}}<li>{{.}}</li>{{end}}</ul>
+{{- end}}
+{{- end}}
+<h2>Kernel Log ({{.DMesgSource}}, last {{len .DMesgExcerpt}} lines)</h2>
+<pre>{{range .DMesgExcerpt}}{{.}}
+{{end}}</pre>
+<h2>Crash Dump Service</h2>
+<table>
+<tr><th>Running kernel</th><td>{{.RunningKernel}}</td></tr>
+<tr><th>Reserved memory</th><td>{{.Reservation.ReservedMemory}} bytes</td></tr>
+<tr><th>crashkernel parameter</th><td>{{.Reservation.CrashKernel}}</td></tr>
+<tr><th>crashkernel in grub</th><td>{{.Reservation.GrubCrashKernel}}</td></tr>
+<tr><th>Reboot needed</th><td>{{.Reservation.RebootNeeded}}</td></tr>
+</table>
+<h3>Configuration</h3>
+<pre>{{printf "%s" .Configuration}}</pre>
+<h3>kdump-tools settings</h3>
+<pre>{{.KDumpEnv}}</pre>
+</body></html>
+`
+
+var (
+	reportMarkdownTemplate = template.Must(template.New("ReportMarkdown").
+				Funcs(template.FuncMap{"join": strings.Join}).Parse(reportMarkdown))
+	reportHTMLTemplate = htmltemplate.Must(htmltemplate.New("ReportHTML").
+				Funcs(htmltemplate.FuncMap{"join": strings.Join}).Parse(reportHTML))
+)
+
+// Crash report file names in the crash directory
+func CrashReportFiles(name string) (string, string, string) {
+	base := fmt.Sprintf("%s/%s/report.%s", kdumpCrashDir, name, name)
+	return base + ".json", base + ".md", base + ".html"
+}
+
+// Write a crash report in JSON, Markdown and HTML to the crash directory.
+// Returns the Markdown report.
+func WriteCrashReport(r *CrashReport) (string, error) {
+	jsonFile, mdFile, htmlFile := CrashReportFiles(r.Name)
+	js, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := safeWriteFile(jsonFile, append(js, '\n')); err != nil {
+		return "", err
+	}
+
+	var md bytes.Buffer
+	if err := reportMarkdownTemplate.Execute(&md, r); err != nil {
+		return "", fmt.Errorf("crash report template error: %s", err)
+	}
+	if err := safeWriteFile(mdFile, md.Bytes()); err != nil {
+		return "", err
+	}
+
+	var html bytes.Buffer
+	if err := reportHTMLTemplate.Execute(&html, r); err != nil {
+		return "", fmt.Errorf("crash report template error: %s", err)
+	}
+	if err := safeWriteFile(htmlFile, html.Bytes()); err != nil {
+		return "", err
+	}
+	return md.String(), nil
+}
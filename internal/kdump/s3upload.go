@@ -0,0 +1,428 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3MetaSHA256    = "X-Amz-Meta-Sha256"
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4Time       = "20060102T150405Z"
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Files larger than a part are uploaded in parts. Parts must be at least
+// 5 MB, and an object can have at most 10000 parts.
+var s3PartSize int64 = 64 << 20
+
+// Upload to an S3 compatible bucket, with path style requests signed with
+// AWS Signature Version 4. The payload of each request is signed, so the
+// server checks its SHA-256. Large files are uploaded in parts, and a
+// multipart upload left by an interrupted upload is continued, reusing
+// only the parts whose ETag matches the MD5 of the local part. The SHA-256
+// of the file is stored in the object metadata.
+type s3Uploader struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func newS3Uploader(d *UploadDest, u *url.URL) (*s3Uploader, error) {
+	p := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if u.Host == "" || p[0] == "" {
+		return nil, fmt.Errorf("no host or bucket in upload URL %s", d.URL)
+	}
+	client, err := uploadHTTPClient(d.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Uploader{
+		client:    client,
+		endpoint:  &url.URL{Scheme: "https", Host: u.Host},
+		bucket:    p[0],
+		region:    d.Region,
+		accessKey: d.AccessKeyID,
+		secretKey: d.SecretAccessKey,
+	}
+	if u.Scheme == "s3+http" {
+		s.endpoint.Scheme = "http"
+	}
+	if len(p) > 1 {
+		s.prefix = strings.Trim(p[1], "/")
+	}
+	if s.region == "" {
+		s.region = s3DefaultRegion
+	}
+	return s, nil
+}
+
+func (s *s3Uploader) key(file string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, file), "/")
+}
+
+// Encode a string as SigV4 requires, keeping only unreserved characters
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a request with AWS Signature Version 4. All x-amz headers and the
+// host are signed.
+func (s *s3Uploader) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzdate := t.UTC().Format(sigV4Time)
+	date := amzdate[:8]
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		s3Query(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		sigV4Algorithm, amzdate, scope, hex.EncodeToString(digest[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.accessKey, scope, signed, signature))
+}
+
+// Make a signed request for an object, or for the bucket if key is empty
+func (s *s3Uploader) do(method, key string, query url.Values, header http.Header,
+	body io.ReadSeeker, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+		req.GetBody = func() (io.ReadCloser, error) {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(body), nil
+		}
+	}
+	if payloadHash == "" {
+		payloadHash = emptySHA256
+	}
+	s.sign(req, payloadHash, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, httpError(resp)
+	}
+	return resp, nil
+}
+
+// Make a request and decode its XML response. Some errors come with a
+// success status and an Error document.
+func (s *s3Uploader) doXML(method, key string, query url.Values, body []byte, v interface{}) error {
+	var rd io.ReadSeeker
+	hash := ""
+	if body != nil {
+		rd = bytes.NewReader(body)
+		sum := sha256.Sum256(body)
+		hash = hex.EncodeToString(sum[:])
+	}
+	resp, err := s.do(method, key, query, nil, rd, int64(len(body)), hash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &e) == nil && e.XMLName.Local == "Error" {
+		return fmt.Errorf("%s: %s", e.Code, e.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, v)
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+	Size       int64 `xml:",omitempty"`
+}
+
+// Find a multipart upload of a key left by an interrupted upload
+func (s *s3Uploader) findMultipartUpload(key string) (string, error) {
+	var res struct {
+		Upload []struct {
+			Key      string
+			UploadId string
+		}
+	}
+	query := url.Values{"uploads": {""}, "prefix": {key}}
+	if err := s.doXML(http.MethodGet, "", query, nil, &res); err != nil {
+		return "", err
+	}
+	for _, u := range res.Upload {
+		if u.Key == key {
+			return u.UploadId, nil
+		}
+	}
+	return "", nil
+}
+
+// Parts uploaded so far by a multipart upload
+func (s *s3Uploader) listParts(key, id string) (map[int]s3Part, error) {
+	parts := make(map[int]s3Part)
+	marker := ""
+	for {
+		var res struct {
+			IsTruncated          bool
+			NextPartNumberMarker string
+			Part                 []s3Part
+		}
+		query := url.Values{"uploadId": {id}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		if err := s.doXML(http.MethodGet, key, query, nil, &res); err != nil {
+			return nil, err
+		}
+		for _, p := range res.Part {
+			parts[p.PartNumber] = p
+		}
+		if !res.IsTruncated || res.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = res.NextPartNumberMarker
+	}
+}
+
+// SHA-256 and MD5 of a part of a file
+func sectionSums(r *io.SectionReader) (string, string, error) {
+	sh := sha256.New()
+	mh := md5.New()
+	if _, err := io.Copy(io.MultiWriter(sh, mh), r); err != nil {
+		return "", "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(sh.Sum(nil)), hex.EncodeToString(mh.Sum(nil)), nil
+}
+
+func (s *s3Uploader) putObject(f *os.File, size int64, key, sum string) error {
+	r := io.NewSectionReader(f, 0, size)
+	header := http.Header{s3MetaSHA256: {sum}}
+	resp, err := s.do(http.MethodPut, key, nil, header, r, size, sum)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Uploader) putMultipart(f *os.File, size int64, key, sum string) (bool, error) {
+	id, err := s.findMultipartUpload(key)
+	if err != nil {
+		return false, err
+	}
+	resumed := id != ""
+	parts := make(map[int]s3Part)
+	if resumed {
+		if parts, err = s.listParts(key, id); err != nil {
+			return false, err
+		}
+	} else {
+		var res struct{ UploadId string }
+		header := http.Header{s3MetaSHA256: {sum}}
+		resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, "")
+		if err != nil {
+			return false, err
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return false, err
+		}
+		id = res.UploadId
+	}
+
+	nparts := int((size + s3PartSize - 1) / s3PartSize)
+	done := make([]s3Part, nparts)
+	for i := 0; i < nparts; i++ {
+		n := i + 1
+		off := int64(i) * s3PartSize
+		psize := s3PartSize
+		if off+psize > size {
+			psize = size - off
+		}
+		r := io.NewSectionReader(f, off, psize)
+		hash, md5sum, err := sectionSums(r)
+		if err != nil {
+			return resumed, err
+		}
+		// The ETag of a part is its MD5, except with some server side
+		// encryption, where the part is uploaded again
+		if p, ok := parts[n]; ok && p.Size == psize && strings.Trim(p.ETag, `"`) == md5sum {
+			done[i] = s3Part{PartNumber: n, ETag: p.ETag}
+			continue
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {id}}
+		resp, err := s.do(http.MethodPut, key, query, nil, r, psize, hash)
+		if err != nil {
+			return resumed, fmt.Errorf("part %d: %s", n, err)
+		}
+		resp.Body.Close()
+		done[i] = s3Part{PartNumber: n, ETag: resp.Header.Get("ETag")}
+	}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []s3Part
+	}{Part: done}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return resumed, err
+	}
+	return resumed, s.doXML(http.MethodPost, key, url.Values{"uploadId": {id}}, body, nil)
+}
+
+func (s *s3Uploader) mkdir(dir string) error {
+	return nil
+}
+
+func (s *s3Uploader) put(local, remote, sum string) (bool, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() <= s3PartSize {
+		return false, s.putObject(f, fi.Size(), s.key(remote), sum)
+	}
+	return s.putMultipart(f, fi.Size(), s.key(remote), sum)
+}
+
+// The SHA-256 in the object metadata is set by the uploader, but the
+// server checked the SHA-256 of each part uploaded, and reused parts were
+// checked against their MD5, so it holds for the object.
+func (s *s3Uploader) sha256(file string) (string, error) {
+	resp, err := s.do(http.MethodHead, s.key(file), nil, nil, nil, 0, "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get(s3MetaSHA256), nil
+}
+
+func (s *s3Uploader) remove(file string) error {
+	resp, err := s.do(http.MethodDelete, s.key(file), nil, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
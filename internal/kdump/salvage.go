@@ -0,0 +1,227 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const incompleteSuffix = "-incomplete"
+
+// Names of the vmcore in a crash directory, best first. kdump-config
+// writes the vmcore to a temporary file which is renamed when complete,
+// and falls back to copying /proc/vmcore if makedumpfile fails.
+func crashDumpNames(name string) []string {
+	return []string{
+		fmt.Sprintf("dump.%s", name),
+		fmt.Sprintf("vmcore.%s", name),
+		"dump" + incompleteSuffix,
+		"vmcore" + incompleteSuffix,
+	}
+}
+
+// Check a kdump-compressed dump for the incomplete flag set by
+// makedumpfile, and for truncation of its page descriptors or page data
+func checkDiskDump(f *os.File, size int64) string {
+	h, err := readDiskDumpHeader(f)
+	if err != nil {
+		return fmt.Sprintf("truncated: %s", err)
+	}
+	if h.Status&dumpDHIncomplete != 0 {
+		return "flagged incomplete by makedumpfile"
+	}
+	dd, err := newDiskDumpPhys(f, h)
+	if err != nil {
+		return fmt.Sprintf("truncated: %s", err)
+	}
+	var npages int64
+	for _, b := range dd.bitmap {
+		npages += int64(bits.OnesCount8(b))
+	}
+	if npages == 0 {
+		return ""
+	}
+	descEnd := dd.descStart + npages*pageDescSize
+	if size < descEnd {
+		return fmt.Sprintf("truncated: %d of %d page descriptors", (size-dd.descStart)/pageDescSize, npages)
+	}
+	// Descriptors are not in the order of the page data, as pages that
+	// are all zeroes share the descriptor of one zero page, so the end of
+	// the page data is found from all of them
+	r := bufio.NewReaderSize(io.NewSectionReader(f, dd.descStart, descEnd-dd.descStart), 1<<20)
+	var desc [pageDescSize]byte
+	var dataEnd int64
+	for i := int64(0); i < npages; i++ {
+		if _, err := io.ReadFull(r, desc[:]); err != nil {
+			return fmt.Sprintf("truncated: %s", err)
+		}
+		offset := int64(binary.LittleEndian.Uint64(desc[0:]))
+		psize := int64(binary.LittleEndian.Uint32(desc[8:]))
+		if offset == 0 {
+			return "truncated: page data is missing"
+		}
+		if offset+psize > dataEnd {
+			dataEnd = offset + psize
+		}
+	}
+	if dataEnd > size {
+		return "truncated: page data is missing"
+	}
+	return ""
+}
+
+// Check that all segments of an ELF vmcore are in the file
+func checkELFDump(f *os.File, size int64) string {
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return fmt.Sprintf("truncated: %s", err)
+	}
+	for _, p := range ef.Progs {
+		if int64(p.Off+p.Filesz) > size {
+			return fmt.Sprintf("truncated: segment at %#x ends beyond end of file", p.Paddr)
+		}
+	}
+	return ""
+}
+
+// Find why a vmcore is incomplete. Returns "" for a complete dump.
+func checkCrashDump(fname string) string {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err.Error()
+	}
+
+	reason := ""
+	switch dumpFormat(f) {
+	case DumpFormatKdump:
+		reason = checkDiskDump(f, fi.Size())
+	case DumpFormatELF:
+		reason = checkELFDump(f, fi.Size())
+	default:
+		reason = "unknown crash dump format"
+	}
+	if reason == "" && strings.HasSuffix(fname, incompleteSuffix) {
+		reason = "crash dump capture did not finish"
+	}
+	return reason
+}
+
+type dumpCheckEntry struct {
+	size   int64
+	mtime  time.Time
+	reason string
+}
+
+var dumpCheckCache = struct {
+	sync.Mutex
+	entries map[string]dumpCheckEntry
+}{entries: make(map[string]dumpCheckEntry)}
+
+// Get why a saved crash dump is incomplete, or "" if it is complete. The
+// result is cached until the dump file changes. For an encrypted dump,
+// the result of the check before encryption is returned.
+func IncompleteReason(name string) string {
+	dumpfile, encrypted := CrashDumpFile(name)
+	if encrypted {
+		meta, _ := ReadDumpMeta(name)
+		return meta.Incomplete
+	}
+	fi, err := os.Stat(dumpfile)
+	if err != nil {
+		return err.Error()
+	}
+
+	dumpCheckCache.Lock()
+	e, ok := dumpCheckCache.entries[name]
+	dumpCheckCache.Unlock()
+	if ok && e.size == fi.Size() && e.mtime.Equal(fi.ModTime()) {
+		return e.reason
+	}
+	reason := checkCrashDump(dumpfile)
+	dumpCheckCache.Lock()
+	dumpCheckCache.entries[name] = dumpCheckEntry{fi.Size(), fi.ModTime(), reason}
+	dumpCheckCache.Unlock()
+	return reason
+}
+
+// What was recovered from an incomplete crash dump
+type SalvageResult struct {
+	Incomplete  string
+	DMesgLines  int
+	DMesgError  string // why the kernel log was not salvaged
+	VMCoreInfo  bool
+	VMCoreError string
+}
+
+// Recover the kernel log and VMCOREINFO from a crash dump, keeping them in
+// the crash directory so they remain available if the vmcore is deleted.
+// The kernel log is only written if it is longer than the saved one.
+func SalvageCrashDump(crashdump os.FileInfo) (*SalvageResult, error) {
+	name := crashdump.Name()
+	dumpfile, encrypted := CrashDumpFile(name)
+	if encrypted {
+		return nil, errEncrypted
+	}
+	res := &SalvageResult{Incomplete: IncompleteReason(name)}
+	// Cached results derived from the kernel log and VMCOREINFO are
+	// recomputed, and so is the crash signature
+	defer forgetCrashDump(name)
+
+	vmi, err := ReadVMCoreInfo(dumpfile)
+	if err != nil {
+		res.VMCoreError = err.Error()
+	} else {
+		_, err := UpdateDumpMeta(name, func(m *DumpMeta) {
+			m.VMCoreInfo = vmi
+			m.Incomplete = res.Incomplete
+			m.Signature = ""
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.VMCoreInfo = true
+	}
+
+	dmesg, err := ExtractDMesg(dumpfile)
+	if err != nil {
+		res.DMesgError = err.Error()
+	}
+	if dmesg == "" {
+		return res, nil
+	}
+	dmesgFile := crashDirFile(name, fmt.Sprintf("dmesg.%s", name))
+	old, _ := os.Stat(dmesgFile)
+	if old != nil && old.Size() >= int64(len(dmesg)) {
+		res.DMesgError = "saved kernel log is not shorter than the one in the vmcore"
+		return res, nil
+	}
+	if err := safeWriteFile(dmesgFile, []byte(dmesg)); err != nil {
+		return nil, err
+	}
+	if err := updateManifestEntry(name, path.Base(dmesgFile)); err != nil {
+		return nil, err
+	}
+	_, err = UpdateDumpMeta(name, func(m *DumpMeta) {
+		m.Signature = ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.DMesgLines = strings.Count(dmesg, "\n")
+	return res, nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Write a kdump-compressed dump of three pages, where the last page is all
+// zeroes and shares the descriptor of the zero page written first
+func writeDiskDump(t *testing.T) string {
+	t.Helper()
+	const bs = 4096
+	le := binary.LittleEndian
+	buf := make([]byte, 4*bs)
+	copy(buf, diskDumpSignature)
+	le.PutUint32(buf[8:], 6)     // version
+	le.PutUint32(buf[428:], bs)  // block size
+	le.PutUint32(buf[432:], 1)   // sub-header blocks
+	le.PutUint32(buf[436:], 2)   // bitmap blocks
+	le.PutUint32(buf[440:], 3)   // max mapnr
+	le.PutUint64(buf[bs+96:], 3) // max mapnr, version 6
+	buf[3*bs] = 0x7              // 2nd bitmap: pfns 0 to 2
+
+	descStart := int64(len(buf))
+	dataStart := uint64(descStart) + 3*pageDescSize
+	descs := []struct {
+		offset uint64
+		size   uint32
+	}{
+		{dataStart + 10, 100}, // pfn 0
+		{dataStart + 110, 50}, // pfn 1
+		{dataStart, 10},       // pfn 2, the zero page
+	}
+	for _, d := range descs {
+		var desc [pageDescSize]byte
+		le.PutUint64(desc[0:], d.offset)
+		le.PutUint32(desc[8:], d.size)
+		buf = append(buf, desc[:]...)
+	}
+	buf = append(buf, make([]byte, 160)...)
+
+	f, err := ioutil.TempFile("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestCheckDiskDumpZeroPage(t *testing.T) {
+	fname := writeDiskDump(t)
+	defer os.Remove(fname)
+	if reason := checkCrashDump(fname); reason != "" {
+		t.Errorf("complete dump: %s", reason)
+	}
+
+	// The descriptor of the last page is within the file, but the data
+	// of pfn 1 is not
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(fname, fi.Size()-20); err != nil {
+		t.Fatal(err)
+	}
+	if reason := checkCrashDump(fname); reason == "" {
+		t.Error("truncated dump found complete")
+	}
+}
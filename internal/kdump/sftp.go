@@ -0,0 +1,228 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The ssh clients can be replaced by stand-ins to test uploads
+var (
+	sshCmd  = "/usr/bin/ssh"
+	sftpCmd = "/usr/bin/sftp"
+	scpCmd  = "/usr/bin/scp"
+)
+
+var sha256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Upload over SFTP, or over SCP. The SHA-256 of uploaded files is
+// computed by running sha256sum on the server, so servers that only allow
+// file transfer can't verify uploads. SCP can't resume a transfer, so
+// partial files at SCP destinations are continued by appending over ssh.
+type sshUploader struct {
+	sftp bool
+	host string // [user@]host
+	port string
+	dir  string
+	opts []string
+}
+
+func newSSHUploader(d *UploadDest, u *url.URL) (*sshUploader, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in upload URL %s", d.URL)
+	}
+	s := &sshUploader{
+		sftp: u.Scheme == "sftp",
+		host: u.Hostname(),
+		port: u.Port(),
+		dir:  u.Path,
+	}
+	if u.User != nil && u.User.Username() != "" {
+		s.host = u.User.Username() + "@" + s.host
+	}
+	if s.dir == "" {
+		s.dir = "."
+	}
+	// Host keys are never accepted without checking. Without a known hosts
+	// file for the destination, the system known hosts files are used.
+	s.opts = []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=30",
+		"-o", "StrictHostKeyChecking=yes"}
+	if d.KeyFile != "" {
+		s.opts = append(s.opts, "-o", "IdentitiesOnly=yes", "-i", d.KeyFile)
+	}
+	if d.KnownHostsFile != "" {
+		s.opts = append(s.opts, "-o", "UserKnownHostsFile="+d.KnownHostsFile)
+	}
+	return s, nil
+}
+
+func (s *sshUploader) path(file string) string {
+	return path.Join(s.dir, file)
+}
+
+// Arguments of ssh, which takes the port with -p, or of sftp and scp,
+// which take it with -P
+func (s *sshUploader) args(portopt string, args ...string) []string {
+	a := append([]string{}, s.opts...)
+	if s.port != "" {
+		a = append(a, portopt, s.port)
+	}
+	return append(a, args...)
+}
+
+func cmdError(cmd *exec.Cmd, err error, out []byte) error {
+	return fmt.Errorf("%s: %s: %s", path.Base(cmd.Path), err,
+		strings.TrimSpace(string(out)))
+}
+
+// Run a shell command on the server
+func (s *sshUploader) ssh(stdin io.Reader, command string) ([]byte, error) {
+	cmd := exec.Command(sshCmd, s.args("-p", "--", s.host, command)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, cmdError(cmd, err, stderr.Bytes())
+	}
+	return out, nil
+}
+
+// Run sftp batch commands
+func (s *sshUploader) batch(commands ...string) ([]byte, error) {
+	cmd := exec.Command(sftpCmd, s.args("-P", "-b", "-", "--", s.host)...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, cmdError(cmd, err, stderr.Bytes())
+	}
+	return out, nil
+}
+
+// Quote a path for the remote shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Quote a path for an sftp batch command
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (s *sshUploader) mkdir(dir string) error {
+	if s.sftp {
+		// A leading "-" ignores the error if the directory exists
+		_, err := s.batch("-mkdir " + sftpQuote(s.path(dir)))
+		return err
+	}
+	_, err := s.ssh(nil, "mkdir -p -- "+shellQuote(s.path(dir)))
+	return err
+}
+
+func (s *sshUploader) size(file string) (int64, error) {
+	if s.sftp {
+		out, err := s.batch("-ls -ln " + sftpQuote(s.path(file)))
+		if err != nil {
+			return -1, err
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 9 || strings.HasPrefix(line, "sftp>") {
+				continue
+			}
+			return strconv.ParseInt(fields[4], 10, 64)
+		}
+		return -1, nil
+	}
+	out, err := s.ssh(nil, "stat -c %s -- "+shellQuote(s.path(file))+" 2>/dev/null || echo -1")
+	if err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// A partial file left at the destination by an interrupted upload is
+// continued. A file of the same size is taken as uploaded, and checked.
+func (s *sshUploader) put(local, remote, sum string) (bool, error) {
+	fi, err := os.Stat(local)
+	if err != nil {
+		return false, err
+	}
+	rsize, err := s.size(remote)
+	if err != nil {
+		return false, err
+	}
+	if rsize > 0 && rsize <= fi.Size() {
+		if rsize == fi.Size() {
+			return true, nil
+		}
+		return true, s.putFrom(local, remote, rsize)
+	}
+	return false, s.putFrom(local, remote, 0)
+}
+
+func (s *sshUploader) putFrom(local, remote string, offset int64) error {
+	rpath := s.path(remote)
+	if s.sftp {
+		op := "put"
+		if offset > 0 {
+			op = "reput"
+		}
+		_, err := s.batch(op + " " + sftpQuote(local) + " " + sftpQuote(rpath))
+		return err
+	}
+	if offset == 0 {
+		cmd := exec.Command(scpCmd, s.args("-P", "-q", "--", local, s.host+":"+rpath)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return cmdError(cmd, err, out)
+		}
+		return nil
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = s.ssh(f, "cat >> "+shellQuote(rpath))
+	return err
+}
+
+func (s *sshUploader) sha256(file string) (string, error) {
+	cmd := exec.Command(sshCmd, s.args("-p", "--", s.host,
+		"sha256sum -- "+shellQuote(s.path(file)))...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 255 {
+		return "", cmdError(cmd, err, stderr.Bytes())
+	}
+	// Any other failure means the server can't run sha256sum
+	fields := strings.Fields(string(out))
+	if err != nil || len(fields) == 0 || !sha256Re.MatchString(fields[0]) {
+		return "", nil
+	}
+	return fields[0], nil
+}
+
+func (s *sshUploader) remove(file string) error {
+	if s.sftp {
+		_, err := s.batch("rm " + sftpQuote(s.path(file)))
+		return err
+	}
+	_, err := s.ssh(nil, "rm -f -- "+shellQuote(s.path(file)))
+	return err
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Stand-ins for the ssh clients, acting on the local filesystem as the
+// server. Each logs its arguments and checks that the host follows "--".
+const fakeSSHPrologue = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/args.log"
+while [ $# -gt 0 ] && [ "$1" != "--" ]; do shift; done
+[ "$1" = "--" ] || { echo "no -- before the host" >&2; exit 255; }
+shift
+`
+
+const fakeSSH = fakeSSHPrologue + `
+[ "$1" = "kdump@backup" ] || { echo "bad host $1" >&2; exit 255; }
+exec sh -c "$2"
+`
+
+const fakeSFTP = fakeSSHPrologue + `
+[ "$1" = "kdump@backup" ] || { echo "bad host $1" >&2; exit 255; }
+while IFS= read -r line; do
+	ignore=
+	case "$line" in -*) ignore=1; line=${line#-} ;; esac
+	eval "set -- $line"
+	case "$1" in
+	mkdir) mkdir "$2" ;;
+	ls) [ -e "$3" ] && echo "-rw-r--r-- 1 0 0 $(stat -c %s "$3") Jan 1 00:00 $3" ;;
+	put) cp "$2" "$3" ;;
+	reput) tail -c +$(($(stat -c %s "$3") + 1)) "$2" >> "$3" ;;
+	rm) rm "$2" ;;
+	*) false ;;
+	esac || [ -n "$ignore" ] || exit 1
+done
+`
+
+const fakeSCP = fakeSSHPrologue + `
+case "$2" in kdump@backup:*) ;; *) echo "bad target $2" >&2; exit 1 ;; esac
+cp "$1" "${2#kdump@backup:}"
+`
+
+// Use the fake ssh clients until cleanup is called. Returns a temporary
+// directory for the test and the log of the client arguments.
+func setFakeSSH(t *testing.T) (string, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := []struct {
+		cmd    *string
+		name   string
+		script string
+	}{
+		{&sshCmd, "ssh", fakeSSH},
+		{&sftpCmd, "sftp", fakeSFTP},
+		{&scpCmd, "scp", fakeSCP},
+	}
+	saved := []string{sshCmd, sftpCmd, scpCmd}
+	cleanup := func() {
+		sshCmd, sftpCmd, scpCmd = saved[0], saved[1], saved[2]
+		os.RemoveAll(dir)
+	}
+	for _, tool := range tools {
+		fname := filepath.Join(dir, tool.name)
+		if err := ioutil.WriteFile(fname, []byte(tool.script), 0755); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		*tool.cmd = fname
+	}
+	return dir, filepath.Join(dir, "args.log"), cleanup
+}
+
+func TestSSHUpload(t *testing.T) {
+	for _, scheme := range []string{"sftp", "scp"} {
+		t.Run(scheme, func(t *testing.T) {
+			dir, argsLog, cleanup := setFakeSSH(t)
+			defer cleanup()
+			remote := filepath.Join(dir, "remote")
+			if err := os.Mkdir(remote, 0700); err != nil {
+				t.Fatal(err)
+			}
+			local := filepath.Join(dir, "vmcore.202610191200")
+			data := bytes.Repeat([]byte("crash dump data\n"), 1000)
+			if err := ioutil.WriteFile(local, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			sum, err := fileSHA256(local)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := &UploadDest{
+				Name:           "backup",
+				URL:            scheme + "://kdump@backup:2222" + remote,
+				KnownHostsFile: "/config/auth/known_hosts",
+			}
+			u, err := url.Parse(d.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := newSSHUploader(d, u)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.mkdir("202610191200"); err != nil {
+				t.Fatal(err)
+			}
+			// A partial file left by an interrupted upload is continued
+			rfile := "202610191200/vmcore.202610191200"
+			if err := ioutil.WriteFile(filepath.Join(remote, rfile), data[:5000], 0600); err != nil {
+				t.Fatal(err)
+			}
+			resumed, verified, err := uploadFile(s, local, rfile, sum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !resumed || !verified {
+				t.Errorf("resumed %v, verified %v, want both", resumed, verified)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(remote, rfile))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("uploaded file differs: %v", err)
+			}
+
+			if err := s.remove(rfile); err != nil {
+				t.Fatal(err)
+			}
+			resumed, verified, err = uploadFile(s, local, rfile, sum)
+			if err != nil || resumed || !verified {
+				t.Errorf("upload: resumed %v, verified %v, %v", resumed, verified, err)
+			}
+
+			args, err := ioutil.ReadFile(argsLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(args)), "\n") {
+				if !strings.Contains(line, "StrictHostKeyChecking=yes") ||
+					!strings.Contains(line, "UserKnownHostsFile=/config/auth/known_hosts") ||
+					strings.Contains(line, "accept-new") {
+					t.Errorf("host key options missing: %s", line)
+				}
+				if !strings.Contains(line, "2222") {
+					t.Errorf("port missing: %s", line)
+				}
+			}
+		})
+	}
+}
+
+func TestSSHUploaderHostKeyChecking(t *testing.T) {
+	d := &UploadDest{Name: "backup", URL: "sftp://backup/crash"}
+	u, _ := url.Parse(d.URL)
+	s, err := newSSHUploader(d, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := strings.Join(s.opts, " ")
+	if !strings.Contains(opts, "StrictHostKeyChecking=yes") ||
+		strings.Contains(opts, "UserKnownHostsFile") {
+		t.Errorf("options %q, want strict checking against the system known hosts", opts)
+	}
+}
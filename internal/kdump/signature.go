@@ -0,0 +1,98 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const signatureFrames = 5
+
+var (
+	sigHexRe     = regexp.MustCompile(`0x[0-9a-fA-F]+|\b[0-9a-fA-F]{8,}\b`)
+	sigNumRe     = regexp.MustCompile(`\d+`)
+	sigSpaceRe   = regexp.MustCompile(`\s+`)
+	sigSuffixRe  = regexp.MustCompile(`\.(cold|isra|constprop|part|lto_priv)(\.\d+)?`)
+	sigOffsetRe  = regexp.MustCompile(`\+0x[0-9a-f]+/0x[0-9a-f]+`)
+	sigRawAddrRe = regexp.MustCompile(`^0x[0-9a-f]+`)
+)
+
+// Remove addresses, numbers and other run-to-run noise from a crash reason
+func normaliseReason(s string) string {
+	s = sigHexRe.ReplaceAllString(s, "X")
+	s = sigNumRe.ReplaceAllString(s, "N")
+	return strings.TrimSpace(sigSpaceRe.ReplaceAllString(s, " "))
+}
+
+func normaliseFrame(frame string) string {
+	frame = sigOffsetRe.ReplaceAllString(frame, "")
+	return sigSuffixRe.ReplaceAllString(frame, "")
+}
+
+// Compute a crash signature that is stable for crashes with the same
+// cause: a hash of the crash reason, the top reliable call trace frames
+// and the kernel release.
+func CrashSignature(a *CrashAnalysis, release string) string {
+	reason := a.OopsType
+	if reason == "" {
+		reason = a.PanicMessage
+	}
+	parts := []string{normaliseReason(reason)}
+	for _, frame := range a.CallTrace {
+		if len(parts) > signatureFrames {
+			break
+		}
+		if strings.HasPrefix(frame, "? ") || sigRawAddrRe.MatchString(frame) {
+			continue
+		}
+		parts = append(parts, normaliseFrame(frame))
+	}
+	if parts[0] == "" && len(parts) == 1 {
+		return ""
+	}
+	parts = append(parts, release)
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Get the signature of a saved crash dump. The signature is computed when
+// first needed and stored in the crash dump metadata once the kernel log
+// shows why the system crashed, so a kernel log that is still being
+// written or is truncated is not stuck with a partial signature.
+func GetCrashSignature(crashdump os.FileInfo) string {
+	name := crashdump.Name()
+	meta, err := ReadDumpMeta(name)
+	if err != nil {
+		log.Wlog.Println("Crash signature:", err)
+	}
+	if meta.Signature != "" {
+		return meta.Signature
+	}
+
+	return saveCrashSignature(name, GetCrashAnalysis(crashdump))
+}
+
+// Compute the signature of a crash dump from its analysis, and store it
+// in the crash dump metadata if the crash reason is known
+func saveCrashSignature(name string, a *CrashAnalysis) string {
+	release := ""
+	if vmi, err := GetVMCoreInfo(name); err == nil {
+		release = vmi.KernelRelease
+	}
+	sig := CrashSignature(a, release)
+	if sig == "" || (a.OopsType == "" && a.PanicMessage == "") {
+		return sig
+	}
+	_, err := UpdateDumpMeta(name, func(m *DumpMeta) {
+		m.Signature = sig
+	})
+	if err != nil {
+		log.Wlog.Println("Crash signature:", err)
+	}
+	return sig
+}
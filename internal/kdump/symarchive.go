@@ -0,0 +1,229 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	kernelNotesPath = "/sys/kernel/notes"
+	osReleasePath   = "/proc/sys/kernel/osrelease"
+	debugDir        = "/usr/lib/debug"
+	ntGNUBuildID    = 3
+)
+
+var symbolArchiveMu sync.Mutex
+
+// Kernel symbol archives are kept in the crash directory
+func symbolArchiveDir() string {
+	return fmt.Sprintf("%s/symbols", kdumpCrashDir)
+}
+
+// Build ID and release of the running kernel
+func runningKernel() (string, string, error) {
+	rel, err := ioutil.ReadFile(osReleasePath)
+	if err != nil {
+		return "", "", err
+	}
+	notes, err := ioutil.ReadFile(kernelNotesPath)
+	if err != nil {
+		return "", "", err
+	}
+	buildid := hex.EncodeToString(findNote(binary.LittleEndian, notes, "GNU", ntGNUBuildID))
+	return buildid, strings.TrimSpace(string(rel)), nil
+}
+
+// Archive directory for a kernel. Archives are keyed by build ID, or by
+// release for kernels without a build ID in /sys/kernel/notes.
+func symbolArchive(buildid, release string) string {
+	if buildid != "" {
+		return fmt.Sprintf("%s/%s", symbolArchiveDir(), buildid)
+	}
+	return fmt.Sprintf("%s/%s", symbolArchiveDir(), release)
+}
+
+// Release of the kernel of an archive, from the release file written
+// when it was archived
+func archiveRelease(dir string) string {
+	rel, err := ioutil.ReadFile(fmt.Sprintf("%s/release", dir))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(rel))
+}
+
+// Archive directories of a kernel release. Crash dumps of kernels without
+// BUILD-ID in VMCOREINFO are matched to an archive by release, even though
+// the archive is keyed by the build ID of the running kernel.
+func releaseSymbolArchives(release string) []string {
+	res := make([]string, 0)
+	dentries, _ := ioutil.ReadDir(symbolArchiveDir())
+	for _, d := range dentries {
+		dir := fmt.Sprintf("%s/%s", symbolArchiveDir(), d.Name())
+		if d.IsDir() && archiveRelease(dir) == release {
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dir, fname := path.Split(dst)
+	tmpf, err := ioutil.TempFile(dir, fname)
+	if err != nil {
+		return err
+	}
+	tmpname := tmpf.Name()
+	defer os.Remove(tmpname)
+	if _, err := io.Copy(tmpf, in); err != nil {
+		tmpf.Close()
+		return err
+	}
+	if err := tmpf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, dst)
+}
+
+// Save System.map, kernel config and debug vmlinux (if installed) of the
+// running kernel, the target of the crash dump service, so the crash dumps
+// can still be analysed after the kernel is upgraded.
+func archiveKernelSymbols() error {
+	buildid, release, err := runningKernel()
+	if err != nil {
+		return err
+	}
+	symbolArchiveMu.Lock()
+	defer symbolArchiveMu.Unlock()
+
+	dir := symbolArchive(buildid, release)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files := map[string][]string{
+		"System.map": {fmt.Sprintf("%s/System.map-%s", bootDir, release)},
+		"config":     {fmt.Sprintf("%s/config-%s", bootDir, release)},
+		"vmlinux": {
+			fmt.Sprintf("%s/boot/vmlinux-%s", debugDir, release),
+			fmt.Sprintf("%s/lib/modules/%s/vmlinux", debugDir, release),
+			fmt.Sprintf("%s/vmlinux-%s", debugDir, release),
+		},
+	}
+	for name, srcs := range files {
+		dst := fmt.Sprintf("%s/%s", dir, name)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		for _, src := range srcs {
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if err := copyFile(src, dst); err != nil {
+				log.Elog.Printf("Archive %s: %s", src, err)
+			}
+			break
+		}
+	}
+	return ioutil.WriteFile(fmt.Sprintf("%s/release", dir), []byte(release+"\n"), 0600)
+}
+
+func updateSymbolArchive() {
+	if err := archiveKernelSymbols(); err != nil {
+		log.Wlog.Println("Archive kernel symbols:", err)
+	}
+	PruneKernelSymbols()
+}
+
+// Remove symbol archives not used by any saved crash dump or the running
+// kernel
+func PruneKernelSymbols() {
+	keep := make(map[string]bool)
+	releases := make(map[string]bool)
+	if buildid, release, err := runningKernel(); err == nil {
+		keep[path.Base(symbolArchive(buildid, release))] = true
+	}
+	_, crashdumps := GetCrashFiles()
+	for _, cd := range crashdumps {
+		vmi, err := GetVMCoreInfo(cd.Name())
+		if err != nil {
+			continue
+		}
+		if vmi.BuildID != "" {
+			keep[vmi.BuildID] = true
+		} else {
+			releases[vmi.KernelRelease] = true
+		}
+		keep[vmi.KernelRelease] = true
+	}
+
+	symbolArchiveMu.Lock()
+	defer symbolArchiveMu.Unlock()
+	dentries, err := ioutil.ReadDir(symbolArchiveDir())
+	if err != nil {
+		return
+	}
+	for _, d := range dentries {
+		dir := fmt.Sprintf("%s/%s", symbolArchiveDir(), d.Name())
+		if keep[d.Name()] || releases[archiveRelease(dir)] {
+			continue
+		}
+		log.Ilog.Printf("Removing unused kernel symbol archive %s", d.Name())
+		if err := os.RemoveAll(dir); err != nil {
+			log.Elog.Println("Prune symbol archive:", err)
+		}
+	}
+}
+
+// Find an archived or installed kernel file for a crashed kernel
+func kernelSymbolFiles(vmi *VMCoreInfo, name string) []string {
+	files := make([]string, 0)
+	if vmi.BuildID != "" {
+		files = append(files, fmt.Sprintf("%s/%s", symbolArchive(vmi.BuildID, ""), name))
+	}
+	files = append(files, fmt.Sprintf("%s/%s", symbolArchive("", vmi.KernelRelease), name))
+	if vmi.BuildID == "" {
+		for _, dir := range releaseSymbolArchives(vmi.KernelRelease) {
+			files = append(files, fmt.Sprintf("%s/%s", dir, name))
+		}
+	}
+	return files
+}
+
+// Check if System.map is available for a crashed kernel
+func SymbolsAvailable(vmi *VMCoreInfo) bool {
+	for _, fname := range systemMapPaths(vmi) {
+		if _, err := os.Stat(fname); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Find a debug vmlinux for a crashed kernel
+func DebugVmlinux(vmi *VMCoreInfo) (string, bool) {
+	candidates := append(kernelSymbolFiles(vmi, "vmlinux"),
+		fmt.Sprintf("%s/boot/vmlinux-%s", debugDir, vmi.KernelRelease),
+		fmt.Sprintf("%s/lib/modules/%s/vmlinux", debugDir, vmi.KernelRelease))
+	for _, fname := range candidates {
+		if _, err := os.Stat(fname); err == nil {
+			return fname, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const bootDir = "/boot"
+
+var (
+	kernelAddrRe = regexp.MustCompile(`\[<ffff[0-9a-f]{12}>\]|\b(?:0x)?ffff[0-9a-f]{12}\b`)
+	hexAddrRe    = regexp.MustCompile(`ffff[0-9a-f]{12}`)
+)
+
+type ksym struct {
+	addr uint64
+	name string
+}
+
+// Loaded module address range from a /proc/modules snapshot
+type kmodule struct {
+	name string
+	addr uint64
+	size uint64
+}
+
+// Kernel and module symbols of a crashed kernel
+type symbolTable struct {
+	syms      []ksym
+	textStart uint64
+	textEnd   uint64
+	offset    uint64 // KASLR offset
+	modules   []kmodule
+}
+
+// Read text symbols from a System.map file
+func readSystemMap(fname string) ([]ksym, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	syms := make([]ksym, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[1] {
+		case "T", "t", "W", "w":
+		default:
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		syms = append(syms, ksym{addr, fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		return syms[i].addr < syms[j].addr
+	})
+	return syms, nil
+}
+
+// Read module load addresses saved from /proc/modules
+func readModules(fname string) []kmodule {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mods := make([]kmodule, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name size refcount deps state address
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		size, err1 := strconv.ParseUint(fields[1], 10, 64)
+		addr, err2 := strconv.ParseUint(strings.TrimPrefix(fields[5], "0x"), 16, 64)
+		if err1 != nil || err2 != nil || addr == 0 {
+			continue
+		}
+		mods = append(mods, kmodule{fields[0], addr, size})
+	}
+	return mods
+}
+
+// Find System.map files that may match a crashed kernel, best first
+func systemMapPaths(vmi *VMCoreInfo) []string {
+	return append(kernelSymbolFiles(vmi, "System.map"),
+		fmt.Sprintf("%s/System.map-%s", bootDir, vmi.KernelRelease))
+}
+
+// Load the symbols of the kernel that produced a crash dump
+func loadSymbolTable(name string) (*symbolTable, error) {
+	vmi, err := GetVMCoreInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	if vmi.KernelRelease == "" {
+		return nil, errors.New("kernel release of the crash dump is unknown")
+	}
+	t := &symbolTable{}
+	for _, fname := range systemMapPaths(vmi) {
+		if t.syms, err = readSystemMap(fname); err == nil {
+			break
+		}
+	}
+	if len(t.syms) == 0 {
+		return nil, fmt.Errorf("no System.map for kernel %s", vmi.KernelRelease)
+	}
+	if off, ok := vmi.Entries["KERNELOFFSET"]; ok {
+		t.offset, _ = strconv.ParseUint(off, 16, 64)
+	}
+	t.textStart, t.textEnd = t.syms[0].addr, t.syms[len(t.syms)-1].addr
+	for _, s := range t.syms {
+		switch s.name {
+		case "_stext":
+			t.textStart = s.addr
+		case "_etext":
+			t.textEnd = s.addr
+		}
+	}
+	t.modules = readModules(fmt.Sprintf("%s/%s/modules.%s", kdumpCrashDir, name, name))
+	return t, nil
+}
+
+// Resolve a runtime kernel address to symbol+offset
+func (t *symbolTable) lookup(addr uint64) (string, bool) {
+	for _, m := range t.modules {
+		if addr >= m.addr && addr < m.addr+m.size {
+			return fmt.Sprintf("[%s]+%#x", m.name, addr-m.addr), true
+		}
+	}
+	addr -= t.offset
+	if addr < t.textStart || addr >= t.textEnd {
+		return "", false
+	}
+	i := sort.Search(len(t.syms), func(i int) bool {
+		return t.syms[i].addr > addr
+	}) - 1
+	if i < 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%s+%#x", t.syms[i].name, addr-t.syms[i].addr), true
+}
+
+// Annotate raw kernel text addresses in a kernel log with symbol names
+func (t *symbolTable) symbolize(text string) string {
+	return kernelAddrRe.ReplaceAllStringFunc(text, func(tok string) string {
+		addr, err := strconv.ParseUint(hexAddrRe.FindString(tok), 16, 64)
+		if err != nil {
+			return tok
+		}
+		if sym, ok := t.lookup(addr); ok {
+			return fmt.Sprintf("%s (%s)", tok, sym)
+		}
+		return tok
+	})
+}
+
+// Resolve raw addresses in the kernel log of a crash dump using the
+// System.map of the crashed kernel release
+func SymbolizeDMesg(crashdump os.FileInfo, dmesg string) (string, error) {
+	t, err := loadSymbolTable(crashdump.Name())
+	if err != nil {
+		return dmesg, err
+	}
+	return t.symbolize(dmesg), nil
+}
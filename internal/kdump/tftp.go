@@ -0,0 +1,256 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TFTP opcodes (RFC 1350) and option acknowledgement (RFC 2347)
+const (
+	tftpWRQ   = 2
+	tftpDATA  = 3
+	tftpACK   = 4
+	tftpERROR = 5
+	tftpOACK  = 6
+)
+
+const (
+	tftpPort             = "69"
+	tftpDefaultBlockSize = 512
+	TFTPBlockSize        = 1428 // fills a 1500 byte MTU
+	tftpTimeout          = 5 * time.Second
+	tftpRetries          = 5
+)
+
+var errTFTPTimeout = errors.New("tftp: timeout")
+
+// Upload over TFTP. TFTP is meant for the kernel logs and archives of crash
+// dumps on networks that only reach a TFTP server, so only kernel log
+// files are uploaded from crash directories. TFTP servers don't create
+// directories, so files are written to the directory of the URL with their
+// crash dump id in their name. TFTP can't resume, check or remove files.
+type tftpUploader struct {
+	addr    string
+	dir     string
+	blksize int
+}
+
+func newTFTPUploader(d *UploadDest, u *url.URL) (*tftpUploader, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in upload URL %s", d.URL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = tftpPort
+	}
+	t := &tftpUploader{
+		addr:    net.JoinHostPort(u.Hostname(), port),
+		dir:     strings.TrimPrefix(u.Path, "/"),
+		blksize: d.BlockSize,
+	}
+	if t.blksize == 0 {
+		t.blksize = TFTPBlockSize
+	}
+	return t, nil
+}
+
+// Only kernel logs are uploaded from crash directories
+func (t *tftpUploader) uploads(file string) bool {
+	return strings.HasPrefix(file, "dmesg.")
+}
+
+func (t *tftpUploader) mkdir(dir string) error {
+	return nil
+}
+
+func (t *tftpUploader) put(local, remote, sum string) (bool, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return false, tftpPut(t.addr, path.Join(t.dir, path.Base(remote)), f, fi.Size(), t.blksize)
+}
+
+func (t *tftpUploader) sha256(file string) (string, error) {
+	return "", nil
+}
+
+func (t *tftpUploader) remove(file string) error {
+	return nil
+}
+
+// A TFTP transfer. The server answers a request from a new port, its
+// transfer ID, and the rest of the transfer is with that port.
+type tftpConn struct {
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	peer   *net.UDPAddr
+	buf    []byte
+}
+
+func tftpError(pkt []byte) error {
+	code := binary.BigEndian.Uint16(pkt[2:4])
+	msg := strings.TrimRight(string(pkt[4:]), "\x00")
+	return fmt.Errorf("tftp: %s (error %d)", msg, code)
+}
+
+// Send a packet and wait for a reply the accept function takes, sending it
+// again on timeout. Replies accept ignores, like duplicate ACKs, don't
+// cause a resend.
+func (c *tftpConn) exchange(pkt []byte, accept func([]byte) (bool, error)) error {
+	for try := 0; try < tftpRetries; try++ {
+		dst := c.peer
+		if dst == nil {
+			dst = c.server
+		}
+		if _, err := c.conn.WriteToUDP(pkt, dst); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(tftpTimeout)
+		for {
+			c.conn.SetReadDeadline(deadline)
+			n, from, err := c.conn.ReadFromUDP(c.buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return err
+			}
+			if c.peer == nil {
+				if !from.IP.Equal(c.server.IP) {
+					continue
+				}
+				c.peer = from
+			} else if !from.IP.Equal(c.peer.IP) || from.Port != c.peer.Port {
+				continue
+			}
+			reply := c.buf[:n]
+			if n < 4 {
+				continue
+			}
+			if binary.BigEndian.Uint16(reply) == tftpERROR {
+				return tftpError(reply)
+			}
+			done, err := accept(reply)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		}
+	}
+	return errTFTPTimeout
+}
+
+func (c *tftpConn) abort(msg string) {
+	if c.peer == nil {
+		return
+	}
+	pkt := []byte{0, tftpERROR, 0, 0}
+	pkt = append(append(pkt, msg...), 0)
+	c.conn.WriteToUDP(pkt, c.peer)
+}
+
+func tftpRequest(filename string, opts ...string) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, tftpWRQ})
+	for _, s := range append([]string{filename, "octet"}, opts...) {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// Options acknowledged by the server
+func tftpOptions(pkt []byte) map[string]string {
+	opts := make(map[string]string)
+	fields := strings.Split(strings.TrimRight(string(pkt[2:]), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		opts[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return opts
+}
+
+// Write a file to a TFTP server, negotiating the block size (RFC 2348)
+// and sending the transfer size (RFC 2349). A server without option
+// support gets 512 byte blocks. Block numbers wrap around for files of
+// more than 65535 blocks.
+func tftpPut(server, filename string, r io.Reader, size int64, blksize int) error {
+	saddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := &tftpConn{conn: conn, server: saddr, buf: make([]byte, 65536)}
+
+	req := tftpRequest(filename,
+		"blksize", strconv.Itoa(blksize),
+		"tsize", strconv.FormatInt(size, 10),
+		"timeout", strconv.Itoa(int(tftpTimeout/time.Second)))
+	bsize := tftpDefaultBlockSize
+	err = c.exchange(req, func(reply []byte) (bool, error) {
+		switch binary.BigEndian.Uint16(reply) {
+		case tftpOACK:
+			if v, ok := tftpOptions(reply)["blksize"]; ok {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 8 || n > blksize {
+					err := fmt.Errorf("tftp: bad block size %s from server", v)
+					c.abort(err.Error())
+					return false, err
+				}
+				bsize = n
+			}
+			return true, nil
+		case tftpACK:
+			return binary.BigEndian.Uint16(reply[2:]) == 0, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 4+bsize)
+	data[1] = tftpDATA
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(r, data[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.abort(err.Error())
+			return err
+		}
+		binary.BigEndian.PutUint16(data[2:], block)
+		err = c.exchange(data[:4+n], func(reply []byte) (bool, error) {
+			return binary.BigEndian.Uint16(reply) == tftpACK &&
+				binary.BigEndian.Uint16(reply[2:]) == block, nil
+		})
+		if err != nil {
+			c.abort(err.Error())
+			return err
+		}
+		if n < bsize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write request received by a fake TFTP server
+type fakeTFTPTransfer struct {
+	opts    map[string]string
+	data    []byte
+	sizes   []int // size of each DATA block
+	dupData int   // DATA blocks received again
+}
+
+// TFTP server taking a single write request. It acknowledges the block
+// size in oack, or answers with a plain ACK 0 if oack is empty. DATA block
+// errorAt is answered with an ERROR, and dupACKs sends each ACK twice.
+type fakeTFTP struct {
+	conn    *net.UDPConn
+	oack    string
+	errorAt uint16
+	dupACKs bool
+	done    chan *fakeTFTPTransfer
+}
+
+func newFakeTFTP(t *testing.T) *fakeTFTP {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeTFTP{conn: conn, done: make(chan *fakeTFTPTransfer, 1)}
+}
+
+func (f *fakeTFTP) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeTFTP) serve() {
+	res := &fakeTFTPTransfer{}
+	defer func() { f.done <- res }()
+
+	buf := make([]byte, 65536)
+	f.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, client, err := f.conn.ReadFromUDP(buf)
+	if err != nil || binary.BigEndian.Uint16(buf) != tftpWRQ {
+		return
+	}
+	res.opts = tftpOptions(buf[:n])
+
+	// The transfer continues from a new port
+	tconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer tconn.Close()
+	ack := func(block uint16) {
+		pkt := []byte{0, tftpACK, byte(block >> 8), byte(block)}
+		tconn.WriteToUDP(pkt, client)
+		if f.dupACKs {
+			tconn.WriteToUDP(pkt, client)
+		}
+	}
+	bsize := tftpDefaultBlockSize
+	if f.oack != "" {
+		bsize, _ = strconv.Atoi(f.oack)
+		pkt := append([]byte{0, tftpOACK}, "blksize\x00"+f.oack+"\x00"...)
+		tconn.WriteToUDP(pkt, client)
+	} else {
+		ack(0)
+	}
+
+	next := uint16(1)
+	for {
+		tconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := tconn.ReadFromUDP(buf)
+		if err != nil || n < 4 || binary.BigEndian.Uint16(buf) != tftpDATA {
+			return
+		}
+		block := binary.BigEndian.Uint16(buf[2:])
+		switch {
+		case block == f.errorAt:
+			pkt := append([]byte{0, tftpERROR, 0, 3}, "disk full\x00"...)
+			tconn.WriteToUDP(pkt, client)
+			return
+		case block == next-1:
+			res.dupData++
+			ack(block)
+		case block == next:
+			res.data = append(res.data, buf[4:n]...)
+			res.sizes = append(res.sizes, n-4)
+			ack(block)
+			next++
+			if n-4 < bsize {
+				return
+			}
+		}
+	}
+}
+
+func TestTFTPPut(t *testing.T) {
+	tests := []struct {
+		name    string
+		oack    string
+		size    int
+		errorAt uint16
+		dupACKs bool
+		sizes   []int
+		err     string
+	}{
+		{name: "block size negotiated", oack: "1024", size: 3000, sizes: []int{1024, 1024, 952}},
+		{name: "server without options", size: 1100, sizes: []int{512, 512, 76}},
+		{name: "exact multiple of block size", oack: "1024", size: 2048, sizes: []int{1024, 1024, 0}},
+		{name: "duplicate ACKs", oack: "512", size: 2000, dupACKs: true, sizes: []int{512, 512, 512, 464}},
+		{name: "server error", oack: "1024", size: 3000, errorAt: 2, err: "disk full (error 3)"},
+		{name: "block size too large", oack: "2000", size: 3000, err: "bad block size 2000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeTFTP(t)
+			defer f.conn.Close()
+			f.oack = test.oack
+			f.errorAt = test.errorAt
+			f.dupACKs = test.dupACKs
+			go f.serve()
+
+			data := make([]byte, test.size)
+			for i := range data {
+				data[i] = byte(i * 7 / 3)
+			}
+			err := tftpPut(f.addr(), "crash/dmesg.202610191200", bytes.NewReader(data),
+				int64(len(data)), TFTPBlockSize)
+			res := <-f.done
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.opts["blksize"] != strconv.Itoa(TFTPBlockSize) ||
+				res.opts["tsize"] != strconv.Itoa(test.size) {
+				t.Errorf("request options %v", res.opts)
+			}
+			if !bytes.Equal(res.data, data) {
+				t.Errorf("received %d bytes, want %d", len(res.data), len(data))
+			}
+			if len(res.sizes) != len(test.sizes) {
+				t.Fatalf("block sizes %v, want %v", res.sizes, test.sizes)
+			}
+			for i := range res.sizes {
+				if res.sizes[i] != test.sizes[i] {
+					t.Fatalf("block sizes %v, want %v", res.sizes, test.sizes)
+				}
+			}
+			if res.dupData != 0 {
+				t.Errorf("%d blocks sent again", res.dupData)
+			}
+		})
+	}
+}
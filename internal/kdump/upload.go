@@ -0,0 +1,424 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	uploadStageDir = "/var/lib/vci-kdump/upload"
+
+	// Staged archives are kept for the next attempt of a failed upload,
+	// and removed once unused for this long
+	uploadStageMaxAge = 24 * time.Hour
+
+	UploadQueued  = "queued"
+	UploadRunning = "running"
+	UploadDone    = "done"
+	UploadFailed  = "failed"
+)
+
+// Destination crash dumps are uploaded to
+type UploadDest struct {
+	Name            string
+	URL             string
+	KeyFile         string // sftp and scp
+	KnownHostsFile  string // sftp and scp
+	BearerToken     string // http and https
+	CAFile          string // https and s3
+	Region          string // s3
+	AccessKeyID     string // s3
+	SecretAccessKey string // s3
+	BlockSize       int    // tftp
+}
+
+// Transfer of files to an upload destination. Remote paths are relative to
+// the path of the destination URL.
+type uploader interface {
+	mkdir(dir string) error
+	// Upload a local file with the given SHA-256, continuing a partial
+	// upload left at the destination if possible. Returns true if a partial
+	// upload was continued.
+	put(local, remote, sum string) (bool, error)
+	// SHA-256 of a file at the destination, "" if the destination can't
+	// provide it
+	sha256(file string) (string, error)
+	remove(file string) error
+}
+
+// Uploader of only some of the files of crash directories
+type fileFilter interface {
+	uploads(file string) bool
+}
+
+// Result of the upload of a file
+type UploadFile struct {
+	Name     string
+	Remote   string
+	Size     int64
+	SHA256   string
+	Status   string
+	Resumed  bool
+	Verified bool
+	Error    string
+}
+
+// Upload of crash dumps, or of an archive of crash dumps, to a destination
+type UploadJob struct {
+	ID          string
+	Destination string
+	CrashDumps  []string
+	Bundle      bool
+	Compression string
+	Started     time.Time
+	Status      string
+	Error       string
+	Files       []UploadFile
+
+	filter func(file string) bool // files of crash directories to upload
+}
+
+var (
+	uploadDests = struct {
+		sync.Mutex
+		dests map[string]*UploadDest
+	}{dests: make(map[string]*UploadDest)}
+	uploads = struct {
+		sync.Mutex
+		jobs map[string]*UploadJob
+	}{jobs: make(map[string]*UploadJob)}
+	errUploadScheme = errors.New("unsupported upload URL scheme")
+)
+
+// Set the configured upload destinations
+func SetUploadDestinations(dests []*UploadDest) {
+	m := make(map[string]*UploadDest)
+	for _, d := range dests {
+		m[d.Name] = d
+	}
+	uploadDests.Lock()
+	uploadDests.dests = m
+	uploadDests.Unlock()
+}
+
+func uploadDestination(name string) (*UploadDest, error) {
+	uploadDests.Lock()
+	defer uploadDests.Unlock()
+	d, ok := uploadDests.dests[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown upload destination %s", name)
+	}
+	return d, nil
+}
+
+func newUploader(d *UploadDest) (uploader, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "sftp", "scp":
+		return newSSHUploader(d, u)
+	case "http", "https":
+		return newHTTPUploader(d, u)
+	case "s3", "s3+http":
+		return newS3Uploader(d, u)
+	case "tftp":
+		return newTFTPUploader(d, u)
+	}
+	return nil, errUploadScheme
+}
+
+func (job *UploadJob) setFile(i int, update func(*UploadFile)) {
+	uploads.Lock()
+	update(&job.Files[i])
+	uploads.Unlock()
+}
+
+// Upload a file and check its SHA-256 at the destination. A file that
+// doesn't match after upload is removed, so the next attempt starts over.
+func uploadFile(u uploader, local, remote, sum string) (resumed, verified bool, err error) {
+	resumed, err = u.put(local, remote, sum)
+	if err != nil {
+		return resumed, false, err
+	}
+	rsum, err := u.sha256(remote)
+	if err != nil {
+		return resumed, false, err
+	}
+	if rsum == "" {
+		return resumed, false, nil
+	}
+	if rsum != sum {
+		u.remove(remote)
+		return resumed, false, fmt.Errorf("checksum mismatch after upload: %s", rsum)
+	}
+	return resumed, true, nil
+}
+
+// Name of the staged archive of an upload. It is keyed on all the crash
+// dumps of the upload and the compression, so an archive is only reused
+// for the same upload.
+func stagedArchiveName(job *UploadJob) string {
+	h := sha256.New()
+	for _, id := range job.CrashDumps {
+		fmt.Fprintln(h, id)
+	}
+	fmt.Fprintln(h, job.Compression)
+	key := hex.EncodeToString(h.Sum(nil))[:16]
+	return fmt.Sprintf("crash-dumps-%s-%s%s", job.CrashDumps[0], key, ArchiveSuffix(job.Compression))
+}
+
+// Remove staged archives, and temporary files left while staging them,
+// that have not been used for a while, except those of running uploads
+func pruneStagedArchives() {
+	inuse := make(map[string]bool)
+	uploads.Lock()
+	for _, job := range uploads.jobs {
+		if job.Status == UploadRunning && job.Bundle && len(job.Files) != 0 {
+			inuse[job.Files[0].Name] = true
+		}
+	}
+	uploads.Unlock()
+	dentries, _ := ioutil.ReadDir(uploadStageDir)
+	for _, d := range dentries {
+		fname := filepath.Join(uploadStageDir, d.Name())
+		if inuse[fname] || time.Since(d.ModTime()) < uploadStageMaxAge {
+			continue
+		}
+		log.Ilog.Printf("Removing unused staged upload archive %s", fname)
+		if err := os.Remove(fname); err != nil {
+			log.Wlog.Println("Staged upload archive:", err)
+		}
+	}
+}
+
+// Archive of the crash dumps of an upload, staged for upload. An archive
+// left by an interrupted upload of the same crash dumps is reused.
+func stageArchive(job *UploadJob, crashdumps []os.FileInfo, config []byte) (string, error) {
+	pruneStagedArchives()
+	archive := filepath.Join(uploadStageDir, stagedArchiveName(job))
+	if _, err := os.Stat(archive); err == nil {
+		// Keep it from being pruned while it is retried
+		now := time.Now()
+		os.Chtimes(archive, now, now)
+		return archive, nil
+	}
+	if err := os.MkdirAll(uploadStageDir, 0700); err != nil {
+		return "", err
+	}
+	if err := checkFreeSpace(uploadStageDir, exportSize(crashdumps)); err != nil {
+		return "", err
+	}
+	// Concurrent uploads of the same crash dumps each stage their own
+	// temporary file
+	f, err := ioutil.TempFile(uploadStageDir, filepath.Base(archive)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	err = writeCompressedArchive(f, crashdumps, config, job.Compression, nil)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, archive)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return archive, nil
+}
+
+func (job *UploadJob) fail(err error) {
+	uploads.Lock()
+	job.Status = UploadFailed
+	job.Error = err.Error()
+	uploads.Unlock()
+	log.Elog.Printf("Upload %s to %s: %s", job.ID, job.Destination, err)
+}
+
+// Files to upload: the files of each crash directory, or the staged archive
+func (job *UploadJob) listFiles(u uploader, crashdumps []os.FileInfo, config []byte) ([]UploadFile, error) {
+	if job.Bundle {
+		archive, err := stageArchive(job, crashdumps, config)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(archive)
+		if err != nil {
+			return nil, err
+		}
+		return []UploadFile{{
+			Name:   archive,
+			Remote: filepath.Base(archive),
+			Size:   fi.Size(),
+			Status: UploadQueued,
+		}}, nil
+	}
+	files := make([]UploadFile, 0)
+	for _, cd := range crashdumps {
+		dfiles, err := exportFiles(cd.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range dfiles {
+			if ff, ok := u.(fileFilter); ok && !ff.uploads(f.Name()) {
+				continue
+			}
+			if job.filter != nil && !job.filter(f.Name()) {
+				continue
+			}
+			files = append(files, UploadFile{
+				Name:   crashDirFile(cd.Name(), f.Name()),
+				Remote: path.Join(cd.Name(), f.Name()),
+				Size:   f.Size(),
+				Status: UploadQueued,
+			})
+		}
+	}
+	return files, nil
+}
+
+func runUpload(job *UploadJob, u uploader, crashdumps []os.FileInfo, config []byte) {
+	files, err := job.listFiles(u, crashdumps, config)
+	if err != nil {
+		job.fail(err)
+		return
+	}
+	uploads.Lock()
+	job.Files = files
+	uploads.Unlock()
+
+	if !job.Bundle {
+		for _, cd := range crashdumps {
+			if err := u.mkdir(cd.Name()); err != nil {
+				job.fail(err)
+				return
+			}
+		}
+	}
+	failed := 0
+	for i, f := range files {
+		job.setFile(i, func(f *UploadFile) { f.Status = UploadRunning })
+		var resumed, verified bool
+		sum, err := fileSHA256(f.Name)
+		if err == nil {
+			job.setFile(i, func(f *UploadFile) { f.SHA256 = sum })
+			resumed, verified, err = uploadFile(u, f.Name, f.Remote, sum)
+		}
+		job.setFile(i, func(f *UploadFile) {
+			f.Resumed = resumed
+			f.Verified = verified
+			f.Status = UploadDone
+			if err != nil {
+				f.Status = UploadFailed
+				f.Error = err.Error()
+			}
+		})
+		if err != nil {
+			failed++
+			log.Elog.Printf("Upload %s to %s: %s: %s", job.ID, job.Destination, f.Remote, err)
+		}
+	}
+
+	if failed != 0 {
+		job.fail(fmt.Errorf("%d of %d files failed", failed, len(files)))
+		return
+	}
+	if job.Bundle {
+		os.Remove(files[0].Name)
+	}
+	uploads.Lock()
+	job.Status = UploadDone
+	uploads.Unlock()
+	log.Ilog.Printf("Upload %s of %d crash dumps to %s done in %s", job.ID,
+		len(crashdumps), job.Destination, time.Since(job.Started).Round(time.Second))
+}
+
+func newUploadID() string {
+	id := time.Now().UnixNano() / int64(time.Millisecond)
+	for {
+		s := strconv.FormatInt(id, 10)
+		if _, ok := uploads.jobs[s]; !ok {
+			return s
+		}
+		id++
+	}
+}
+
+func newUpload(dest string, crashdumps []os.FileInfo, bundle bool,
+	compression string) (*UploadJob, uploader, error) {
+	if len(crashdumps) == 0 {
+		return nil, nil, errors.New("no crash dumps to upload")
+	}
+	d, err := uploadDestination(dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := newUploader(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	job := &UploadJob{
+		Destination: dest,
+		CrashDumps:  make([]string, len(crashdumps)),
+		Bundle:      bundle,
+		Compression: compression,
+		Started:     time.Now(),
+		Status:      UploadRunning,
+	}
+	for i, cd := range crashdumps {
+		job.CrashDumps[i] = cd.Name()
+	}
+	uploads.Lock()
+	job.ID = newUploadID()
+	uploads.jobs[job.ID] = job
+	uploads.Unlock()
+	log.Ilog.Printf("Upload %s of %d crash dumps to %s started", job.ID, len(crashdumps), dest)
+	return job, u, nil
+}
+
+// Start uploading crash dumps to a configured destination, either the
+// files of each crash directory or a single archive of the crash dumps.
+// The upload runs in the background.
+func UploadCrashDumps(dest string, crashdumps []os.FileInfo, bundle bool,
+	compression string, config []byte) (*UploadJob, error) {
+	job, u, err := newUpload(dest, crashdumps, bundle, compression)
+	if err != nil {
+		return nil, err
+	}
+	go runUpload(job, u, crashdumps, config)
+	return job, nil
+}
+
+// Uploads running or finished since the service started
+func GetUploads() []UploadJob {
+	uploads.Lock()
+	defer uploads.Unlock()
+	res := make([]UploadJob, 0, len(uploads.jobs))
+	for _, job := range uploads.jobs {
+		j := *job
+		j.Files = append([]UploadFile(nil), job.Files...)
+		res = append(res, j)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"testing"
+)
+
+func TestStagedArchiveName(t *testing.T) {
+	jobs := []*UploadJob{
+		{CrashDumps: []string{"202610191200", "202610181200"}},
+		{CrashDumps: []string{"202610191200", "202610171200", "202610181200"}},
+		{CrashDumps: []string{"202610191200", "202610181200"}, Compression: CompressionGzip},
+		{CrashDumps: []string{"202610191200"}},
+	}
+	seen := make(map[string]bool)
+	for _, job := range jobs {
+		name := stagedArchiveName(job)
+		if seen[name] {
+			t.Errorf("%v: staged archive name %s already used", job.CrashDumps, name)
+		}
+		seen[name] = true
+		if again := stagedArchiveName(job); again != name {
+			t.Errorf("%v: staged archive name %s, then %s", job.CrashDumps, name, again)
+		}
+	}
+}
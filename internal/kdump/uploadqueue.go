@@ -0,0 +1,399 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the upload queue is kept. Changed by tests.
+var uploadQueueFile = "/var/lib/vci-kdump/upload-queue.json"
+
+const (
+	// What is uploaded of a crash dump
+	UploadContentCrashDump   = "crash-dump"
+	UploadContentDMesgReport = "dmesg-and-report"
+
+	QueueCancelled = "cancelled"
+
+	uploadRetryMin = time.Minute
+	uploadRetryMax = 6 * time.Hour
+	// Finished items kept in the queue
+	uploadQueueKeep = 50
+)
+
+// Upload of new crash dumps at boot
+type AutoUpload struct {
+	Destination string
+	Content     string
+	Config      []byte // configuration for crash reports
+}
+
+// Item of the upload queue. Failed uploads stay queued and are retried
+// with backoff until they succeed or are cancelled.
+type QueueItem struct {
+	ID          string    `json:"id"`
+	CrashDump   string    `json:"crash-dump"`
+	Destination string    `json:"destination"`
+	Content     string    `json:"content"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Added       time.Time `json:"added"`
+	LastAttempt time.Time `json:"last-attempt,omitempty"`
+	NextAttempt time.Time `json:"next-attempt,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	UploadID    string    `json:"upload-id,omitempty"`
+
+	cancel bool // cancelled while the upload is running
+}
+
+var uploadQueue = struct {
+	sync.Mutex
+	once   sync.Once
+	items  []*QueueItem
+	policy *AutoUpload
+	wake   chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+func readUploadQueue() []*QueueItem {
+	items := make([]*QueueItem, 0)
+	buf, err := ioutil.ReadFile(uploadQueueFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Elog.Println("Upload queue:", err)
+		}
+		return items
+	}
+	if err := json.Unmarshal(buf, &items); err != nil {
+		log.Elog.Printf("Upload queue: %s: %s", uploadQueueFile, err)
+		return items
+	}
+	for _, item := range items {
+		// Interrupted by a restart of the service
+		if item.Status == UploadRunning {
+			item.Status = UploadQueued
+		}
+	}
+	return items
+}
+
+// Write the queue, dropping the oldest finished items. Called with the
+// queue locked.
+func writeUploadQueue() {
+	finished := 0
+	for i := len(uploadQueue.items) - 1; i >= 0; i-- {
+		switch uploadQueue.items[i].Status {
+		case UploadQueued, UploadRunning:
+			continue
+		}
+		finished++
+		if finished > uploadQueueKeep {
+			uploadQueue.items = append(uploadQueue.items[:i], uploadQueue.items[i+1:]...)
+		}
+	}
+	buf, err := json.MarshalIndent(uploadQueue.items, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(uploadQueueFile), 0700)
+	}
+	if err == nil {
+		err = safeWriteFile(uploadQueueFile, append(buf, '\n'))
+	}
+	if err != nil {
+		log.Elog.Println("Upload queue:", err)
+	}
+}
+
+func wakeUploadQueue() {
+	select {
+	case uploadQueue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Load the queue and start uploading once
+func startUploadQueue() {
+	uploadQueue.once.Do(func() {
+		uploadQueue.Lock()
+		uploadQueue.items = readUploadQueue()
+		uploadQueue.Unlock()
+		go runUploadQueue()
+	})
+}
+
+func retryDelay(attempts int) time.Duration {
+	d := uploadRetryMin
+	for i := 1; i < attempts && d < uploadRetryMax; i++ {
+		d *= 2
+	}
+	if d > uploadRetryMax {
+		d = uploadRetryMax
+	}
+	return d
+}
+
+// Next queued item due for upload, and how long until the next one is due
+func nextQueueItem() (*QueueItem, time.Duration) {
+	uploadQueue.Lock()
+	defer uploadQueue.Unlock()
+	now := time.Now()
+	wait := uploadRetryMax
+	for _, item := range uploadQueue.items {
+		if item.Status != UploadQueued {
+			continue
+		}
+		if !item.NextAttempt.After(now) {
+			item.Status = UploadRunning
+			item.LastAttempt = now
+			item.Attempts++
+			writeUploadQueue()
+			return item, 0
+		}
+		if d := item.NextAttempt.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+func uploadQueueItem(item *QueueItem, policy *AutoUpload) (string, error) {
+	crashdump, err := os.Stat(crashDirFile(item.CrashDump, ""))
+	if err != nil {
+		return "", err
+	}
+	var config []byte
+	filter := func(file string) bool { return true }
+	if item.Content == UploadContentDMesgReport {
+		if policy != nil {
+			config = policy.Config
+		}
+		if _, err := WriteCrashReport(GenerateCrashReport(crashdump, config)); err != nil {
+			return "", err
+		}
+		filter = func(file string) bool {
+			return strings.HasPrefix(file, "dmesg.") || strings.HasPrefix(file, "report.")
+		}
+	}
+	job, u, err := newUpload(item.Destination, []os.FileInfo{crashdump}, false, "")
+	if err != nil {
+		return "", err
+	}
+	job.filter = filter
+	runUpload(job, u, []os.FileInfo{crashdump}, nil)
+	if job.Status != UploadDone {
+		// Show why, not just how many files failed
+		for _, f := range job.Files {
+			if f.Error != "" {
+				return job.ID, fmt.Errorf("%s: %s", job.Error, f.Error)
+			}
+		}
+		return job.ID, fmt.Errorf("%s", job.Error)
+	}
+	return job.ID, nil
+}
+
+// Check that an item can still be uploaded with the current configuration
+func queueItemConfigured(item *QueueItem, policy *AutoUpload) error {
+	if policy == nil {
+		return errors.New("automatic upload is not configured")
+	}
+	if _, err := uploadDestination(item.Destination); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Fail queued items that can't be uploaded with the current configuration,
+// rather than retrying them forever. Called with the queue locked.
+func failUnconfiguredUploads() {
+	changed := false
+	for _, item := range uploadQueue.items {
+		if item.Status != UploadQueued {
+			continue
+		}
+		if err := queueItemConfigured(item, uploadQueue.policy); err != nil {
+			item.Status = UploadFailed
+			item.Error = err.Error()
+			changed = true
+		}
+	}
+	if changed {
+		writeUploadQueue()
+	}
+}
+
+// Record the result of an upload attempt. Called with the queue locked.
+func finishQueueItem(item *QueueItem, id string, err error) {
+	item.UploadID = id
+	item.Error = ""
+	switch {
+	case item.cancel:
+		item.Status = QueueCancelled
+		item.cancel = false
+	case err == nil:
+		item.Status = UploadDone
+		log.Ilog.Printf("Upload queue: crash dump %s uploaded to %s",
+			item.CrashDump, item.Destination)
+	case os.IsNotExist(err):
+		item.Status = UploadFailed
+		item.Error = "crash dump no longer exists"
+	default:
+		item.Status = UploadQueued
+		item.Error = err.Error()
+		item.NextAttempt = time.Now().Add(retryDelay(item.Attempts))
+		log.Elog.Printf("Upload queue: crash dump %s to %s: %s, retrying at %s",
+			item.CrashDump, item.Destination, err,
+			item.NextAttempt.Format(time.RFC3339))
+	}
+	writeUploadQueue()
+}
+
+// Upload queued items one at a time, retrying failed uploads with backoff
+func runUploadQueue() {
+	for {
+		item, wait := nextQueueItem()
+		if item == nil {
+			select {
+			case <-uploadQueue.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+		uploadQueue.Lock()
+		policy := uploadQueue.policy
+		err := queueItemConfigured(item, policy)
+		if err != nil {
+			item.Status = UploadFailed
+			item.Error = err.Error()
+			writeUploadQueue()
+		}
+		uploadQueue.Unlock()
+		if err != nil {
+			continue
+		}
+
+		id, err := uploadQueueItem(item, policy)
+
+		uploadQueue.Lock()
+		finishQueueItem(item, id, err)
+		uploadQueue.Unlock()
+	}
+}
+
+// Add a crash dump to the upload queue, unless it is already queued or
+// uploaded to the destination. Called with the queue locked.
+func enqueueUpload(name string, p *AutoUpload) {
+	for _, item := range uploadQueue.items {
+		if item.CrashDump == name && item.Destination == p.Destination {
+			return
+		}
+	}
+	now := time.Now()
+	item := &QueueItem{
+		ID:          fmt.Sprintf("%s-%s", name, p.Destination),
+		CrashDump:   name,
+		Destination: p.Destination,
+		Content:     p.Content,
+		Status:      UploadQueued,
+		Added:       now,
+		NextAttempt: now,
+	}
+	uploadQueue.items = append(uploadQueue.items, item)
+	writeUploadQueue()
+	log.Ilog.Printf("Upload queue: crash dump %s queued for upload to %s", name, p.Destination)
+}
+
+// Set the automatic upload of new crash dumps. The crash dump saved by
+// the last boot is queued for upload. The queue is kept across reboots.
+// Queued items fail if automatic upload or their destination is no longer
+// configured.
+func SetAutoUpload(p *AutoUpload) {
+	if p == nil && lastBootCrashDump == "" {
+		if _, err := os.Stat(uploadQueueFile); os.IsNotExist(err) {
+			return
+		}
+	}
+	startUploadQueue()
+	uploadQueue.Lock()
+	uploadQueue.policy = p
+	if p != nil && lastBootCrashDump != "" {
+		enqueueUpload(lastBootCrashDump, p)
+	}
+	failUnconfiguredUploads()
+	uploadQueue.Unlock()
+	wakeUploadQueue()
+}
+
+func queueItem(id string) (*QueueItem, error) {
+	for _, item := range uploadQueue.items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return nil, fmt.Errorf("no upload queue item %s", id)
+}
+
+// Cancel a queued upload. A running upload is cancelled when the current
+// attempt finishes.
+func CancelQueuedUpload(id string) error {
+	uploadQueue.Lock()
+	defer uploadQueue.Unlock()
+	item, err := queueItem(id)
+	if err != nil {
+		return err
+	}
+	switch item.Status {
+	case UploadQueued:
+		item.Status = QueueCancelled
+		writeUploadQueue()
+	case UploadRunning:
+		item.cancel = true
+	default:
+		return fmt.Errorf("upload queue item %s is %s", id, item.Status)
+	}
+	return nil
+}
+
+// Retry a queued, failed or cancelled upload now
+func RetryQueuedUpload(id string) error {
+	uploadQueue.Lock()
+	item, err := queueItem(id)
+	if err != nil {
+		uploadQueue.Unlock()
+		return err
+	}
+	if item.Status == UploadRunning {
+		uploadQueue.Unlock()
+		return fmt.Errorf("upload queue item %s is running", id)
+	}
+	item.Status = UploadQueued
+	item.NextAttempt = time.Now()
+	item.cancel = false
+	writeUploadQueue()
+	uploadQueue.Unlock()
+	wakeUploadQueue()
+	return nil
+}
+
+// Items of the upload queue, oldest first
+func GetUploadQueue() []QueueItem {
+	uploadQueue.Lock()
+	defer uploadQueue.Unlock()
+	res := make([]QueueItem, len(uploadQueue.items))
+	for i, item := range uploadQueue.items {
+		res[i] = *item
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Added.Before(res[j].Added)
+	})
+	return res
+}
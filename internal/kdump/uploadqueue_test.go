@@ -0,0 +1,146 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Keep the upload queue in a temporary directory, starting empty
+func setUploadQueue(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := uploadQueueFile
+	uploadQueueFile = filepath.Join(dir, "upload-queue.json")
+	uploadQueue.Lock()
+	uploadQueue.items = nil
+	uploadQueue.policy = nil
+	uploadQueue.Unlock()
+	return func() {
+		uploadQueue.Lock()
+		uploadQueue.items = nil
+		uploadQueue.policy = nil
+		uploadQueue.Unlock()
+		uploadQueueFile = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func queueItemStatus(id, status string) *QueueItem {
+	return &QueueItem{ID: id, CrashDump: id, Destination: "server", Status: status}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{1000, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		if d := retryDelay(test.attempts); d != test.delay {
+			t.Errorf("retry delay after %d attempts %s, want %s", test.attempts, d, test.delay)
+		}
+	}
+}
+
+func TestUploadQueueTrimAndRestart(t *testing.T) {
+	cleanup := setUploadQueue(t)
+	defer cleanup()
+
+	// Finished items beyond the limit are dropped oldest first, while
+	// queued and running items are always kept
+	uploadQueue.Lock()
+	uploadQueue.items = append(uploadQueue.items,
+		queueItemStatus("queued", UploadQueued),
+		queueItemStatus("running", UploadRunning))
+	for i := 0; i < uploadQueueKeep+2; i++ {
+		uploadQueue.items = append(uploadQueue.items,
+			queueItemStatus(fmt.Sprintf("done%d", i), UploadDone))
+	}
+	writeUploadQueue()
+	uploadQueue.Unlock()
+
+	items := readUploadQueue()
+	if len(items) != uploadQueueKeep+2 {
+		t.Fatalf("%d items kept, want %d", len(items), uploadQueueKeep+2)
+	}
+	if items[0].ID != "queued" || items[1].ID != "running" || items[2].ID != "done2" {
+		t.Errorf("items kept %s, %s, %s", items[0].ID, items[1].ID, items[2].ID)
+	}
+	// The running upload was interrupted by the restart
+	if items[1].Status != UploadQueued {
+		t.Errorf("interrupted item is %s after restart", items[1].Status)
+	}
+}
+
+func TestCancelRunningUpload(t *testing.T) {
+	cleanup := setUploadQueue(t)
+	defer cleanup()
+
+	item := queueItemStatus("running", UploadRunning)
+	uploadQueue.Lock()
+	uploadQueue.items = append(uploadQueue.items, item)
+	uploadQueue.Unlock()
+	if err := CancelQueuedUpload("running"); err != nil {
+		t.Fatal(err)
+	}
+	if item.Status != UploadRunning {
+		t.Errorf("running item is %s before the attempt finishes", item.Status)
+	}
+
+	// A failed attempt isn't retried once cancelled
+	uploadQueue.Lock()
+	finishQueueItem(item, "1", errors.New("connection refused"))
+	uploadQueue.Unlock()
+	if item.Status != QueueCancelled || item.cancel {
+		t.Errorf("cancelled item is %s", item.Status)
+	}
+	if err := CancelQueuedUpload("running"); err == nil {
+		t.Error("cancelled item cancelled again")
+	}
+}
+
+func TestFailUnconfiguredUploads(t *testing.T) {
+	cleanup := setUploadQueue(t)
+	defer cleanup()
+	SetUploadDestinations([]*UploadDest{{Name: "server", URL: "sftp://server/crash"}})
+	defer SetUploadDestinations(nil)
+
+	removed := queueItemStatus("removed", UploadQueued)
+	removed.Destination = "old-server"
+	configured := queueItemStatus("configured", UploadQueued)
+	uploadQueue.Lock()
+	uploadQueue.items = append(uploadQueue.items, removed, configured)
+	uploadQueue.policy = &AutoUpload{Destination: "server", Content: UploadContentCrashDump}
+	failUnconfiguredUploads()
+	uploadQueue.Unlock()
+	if removed.Status != UploadFailed || configured.Status != UploadQueued {
+		t.Errorf("items %s and %s with a removed and a configured destination",
+			removed.Status, configured.Status)
+	}
+
+	// Nothing is uploaded once automatic upload is unconfigured
+	uploadQueue.Lock()
+	uploadQueue.policy = nil
+	failUnconfiguredUploads()
+	uploadQueue.Unlock()
+	if configured.Status != UploadFailed {
+		t.Errorf("item is %s without automatic upload", configured.Status)
+	}
+}
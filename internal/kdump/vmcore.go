@@ -0,0 +1,310 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DumpFormatUnknown = "unknown"
+	DumpFormatELF     = "elf"
+	DumpFormatKdump   = "kdump-compressed"
+)
+
+const (
+	diskDumpSignature   = "KDUMP   "
+	diskDumpHeaderSize  = 464
+	diskDumpSubHdrSize  = 104
+	utsLen              = 65
+	vmcoreInfoNoteName  = "VMCOREINFO"
+	maxVMCoreInfoLength = 1 << 20
+)
+
+// Kernel release, build-id, etc. from the VMCOREINFO of a crash dump
+type VMCoreInfo struct {
+	Format        string            `json:"format"`
+	KernelRelease string            `json:"kernel-release"`
+	BuildID       string            `json:"build-id,omitempty"`
+	PageSize      uint64            `json:"page-size"`
+	CrashTime     int64             `json:"crash-time"` // seconds since epoch, 0 if unknown
+	PanicCPU      int               `json:"panic-cpu"`  // -1 if unknown
+	Entries       map[string]string `json:"entries"`
+}
+
+// Fields of the makedumpfile disk_dump_header and kdump_sub_header
+type diskDumpHeader struct {
+	Version          int32
+	Release          string
+	Status           uint32
+	BlockSize        int32
+	SubHdrSize       int32
+	BitmapBlocks     uint32
+	MaxMapNr         uint64
+	CurrentCPU       int32
+	NrCPUs           int32
+	PhysBase         uint64
+	DumpLevel        int32
+	OffsetVMCoreInfo int64
+	SizeVMCoreInfo   uint64
+}
+
+func (vmi *VMCoreInfo) Symbol(name string) (uint64, bool) {
+	return vmi.hexEntry("SYMBOL(" + name + ")")
+}
+
+func (vmi *VMCoreInfo) Size(name string) (uint64, bool) {
+	return vmi.decEntry("SIZE(" + name + ")")
+}
+
+func (vmi *VMCoreInfo) Offset(name string) (uint64, bool) {
+	return vmi.decEntry("OFFSET(" + name + ")")
+}
+
+func (vmi *VMCoreInfo) Number(name string) (uint64, bool) {
+	return vmi.decEntry("NUMBER(" + name + ")")
+}
+
+func (vmi *VMCoreInfo) hexEntry(key string) (uint64, bool) {
+	v, ok := vmi.Entries[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 16, 64)
+	return n, err == nil
+}
+
+func (vmi *VMCoreInfo) decEntry(key string) (uint64, bool) {
+	v, ok := vmi.Entries[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return uint64(n), err == nil
+}
+
+// Parse the "KEY=value" lines of a VMCOREINFO note
+func parseVMCoreInfo(format string, data []byte) *VMCoreInfo {
+	vmi := &VMCoreInfo{
+		Format:   format,
+		PanicCPU: -1,
+		Entries:  make(map[string]string),
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(data, "\x00")))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		vmi.Entries[kv[0]] = kv[1]
+	}
+	vmi.KernelRelease = vmi.Entries["OSRELEASE"]
+	vmi.BuildID = vmi.Entries["BUILD-ID"]
+	vmi.PageSize, _ = strconv.ParseUint(vmi.Entries["PAGESIZE"], 10, 64)
+	vmi.CrashTime, _ = strconv.ParseInt(vmi.Entries["CRASHTIME"], 10, 64)
+	return vmi
+}
+
+func cString(b []byte) string {
+	if n := bytes.IndexByte(b, 0); n >= 0 {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+// Detect the format of a crash dump file from its header
+func dumpFormat(r io.ReaderAt) string {
+	var magic [8]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return DumpFormatUnknown
+	}
+	switch {
+	case string(magic[:]) == diskDumpSignature:
+		return DumpFormatKdump
+	case string(magic[:4]) == elf.ELFMAG:
+		return DumpFormatELF
+	}
+	return DumpFormatUnknown
+}
+
+func readDiskDumpHeader(r io.ReaderAt) (*diskDumpHeader, error) {
+	buf := make([]byte, diskDumpHeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("kdump header: %s", err)
+	}
+	if string(buf[:8]) != diskDumpSignature {
+		return nil, errors.New("kdump header: bad signature")
+	}
+	le := binary.LittleEndian
+	const releaseOff = 12 + 2*utsLen
+	h := &diskDumpHeader{
+		Version:      int32(le.Uint32(buf[8:])),
+		Release:      cString(buf[releaseOff : releaseOff+utsLen]),
+		Status:       le.Uint32(buf[424:]),
+		BlockSize:    int32(le.Uint32(buf[428:])),
+		SubHdrSize:   int32(le.Uint32(buf[432:])),
+		BitmapBlocks: le.Uint32(buf[436:]),
+		MaxMapNr:     uint64(le.Uint32(buf[440:])),
+		CurrentCPU:   int32(le.Uint32(buf[456:])),
+		NrCPUs:       int32(le.Uint32(buf[460:])),
+	}
+	if h.BlockSize <= 0 {
+		return nil, fmt.Errorf("kdump header: invalid block size %d", h.BlockSize)
+	}
+
+	sub := make([]byte, diskDumpSubHdrSize)
+	if _, err := r.ReadAt(sub, int64(h.BlockSize)); err != nil {
+		return nil, fmt.Errorf("kdump sub-header: %s", err)
+	}
+	h.PhysBase = le.Uint64(sub[0:])
+	h.DumpLevel = int32(le.Uint32(sub[8:]))
+	if h.Version >= 3 {
+		h.OffsetVMCoreInfo = int64(le.Uint64(sub[32:]))
+		h.SizeVMCoreInfo = le.Uint64(sub[40:])
+	}
+	if h.Version >= 6 {
+		h.MaxMapNr = le.Uint64(sub[96:])
+	}
+	return h, nil
+}
+
+func diskDumpVMCoreInfo(r io.ReaderAt) (*VMCoreInfo, error) {
+	h, err := readDiskDumpHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.SizeVMCoreInfo == 0 || h.SizeVMCoreInfo > maxVMCoreInfoLength {
+		return nil, errors.New("kdump header: no vmcoreinfo")
+	}
+	data := make([]byte, h.SizeVMCoreInfo)
+	if _, err := r.ReadAt(data, h.OffsetVMCoreInfo); err != nil {
+		return nil, fmt.Errorf("vmcoreinfo: %s", err)
+	}
+	vmi := parseVMCoreInfo(DumpFormatKdump, data)
+	if vmi.KernelRelease == "" {
+		vmi.KernelRelease = h.Release
+	}
+	vmi.PanicCPU = int(h.CurrentCPU)
+	return vmi, nil
+}
+
+// Find the VMCOREINFO note in the PT_NOTE segments of an ELF vmcore
+func elfVMCoreInfo(r io.ReaderAt) (*VMCoreInfo, error) {
+	ef, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_NOTE || prog.Filesz > maxVMCoreInfoLength*4 {
+			continue
+		}
+		notes := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(notes, 0); err != nil {
+			continue
+		}
+		if desc := findNote(ef.ByteOrder, notes, vmcoreInfoNoteName, 0); desc != nil {
+			return parseVMCoreInfo(DumpFormatELF, desc), nil
+		}
+	}
+	return nil, errors.New("ELF vmcore: no VMCOREINFO note")
+}
+
+// Return the descriptor of the first note called name of type ntype
+func findNote(bo binary.ByteOrder, notes []byte, name string, ntype uint32) []byte {
+	align := func(n uint32) int { return int((n + 3) &^ 3) }
+	for len(notes) >= 12 {
+		namesz := bo.Uint32(notes[0:])
+		descsz := bo.Uint32(notes[4:])
+		typ := bo.Uint32(notes[8:])
+		notes = notes[12:]
+		if align(namesz)+align(descsz) > len(notes) {
+			break
+		}
+		nname := cString(notes[:namesz])
+		desc := notes[align(namesz) : align(namesz)+int(descsz)]
+		if nname == name && typ == ntype {
+			return desc
+		}
+		notes = notes[align(namesz)+align(descsz):]
+	}
+	return nil
+}
+
+// Read VMCOREINFO from an ELF or kdump-compressed crash dump file
+func ReadVMCoreInfo(fname string) (*VMCoreInfo, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch dumpFormat(f) {
+	case DumpFormatKdump:
+		return diskDumpVMCoreInfo(f)
+	case DumpFormatELF:
+		return elfVMCoreInfo(f)
+	}
+	return nil, fmt.Errorf("%s: unknown crash dump format", fname)
+}
+
+type vmcoreInfoCacheEntry struct {
+	size  int64
+	mtime time.Time
+	info  *VMCoreInfo
+}
+
+var vmcoreInfoCache = struct {
+	sync.Mutex
+	entries map[string]vmcoreInfoCacheEntry
+}{entries: make(map[string]vmcoreInfoCacheEntry)}
+
+// Get VMCOREINFO of a saved crash dump. Dumps are not modified once
+// saved, so the result is cached until the dump file changes. For an
+// encrypted dump, VMCOREINFO saved in the metadata is returned.
+func GetVMCoreInfo(name string) (*VMCoreInfo, error) {
+	dumpfile, encrypted := CrashDumpFile(name)
+	if encrypted {
+		meta, err := ReadDumpMeta(name)
+		if err != nil {
+			return nil, err
+		}
+		if meta.VMCoreInfo == nil {
+			return nil, errEncrypted
+		}
+		return meta.VMCoreInfo, nil
+	}
+	fi, err := os.Stat(dumpfile)
+	if err != nil {
+		return nil, err
+	}
+
+	vmcoreInfoCache.Lock()
+	e, ok := vmcoreInfoCache.entries[name]
+	vmcoreInfoCache.Unlock()
+	if ok && e.size == fi.Size() && e.mtime.Equal(fi.ModTime()) {
+		return e.info, nil
+	}
+
+	vmi, err := ReadVMCoreInfo(dumpfile)
+	if err != nil {
+		// Salvaged from an incomplete dump earlier
+		if meta, _ := ReadDumpMeta(name); meta.VMCoreInfo != nil {
+			return meta.VMCoreInfo, nil
+		}
+		return nil, err
+	}
+	vmcoreInfoCache.Lock()
+	vmcoreInfoCache.entries[name] = vmcoreInfoCacheEntry{fi.Size(), fi.ModTime(), vmi}
+	vmcoreInfoCache.Unlock()
+	return vmi, nil
+}
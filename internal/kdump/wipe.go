@@ -0,0 +1,205 @@
+// Copyright (c) 2021, AT&T Intellectual Property. All rights reserved.
+// SPDX-License-Identifier: GPL-2.0-only
+package kdump
+
+import (
+	"fmt"
+	"github.com/danos/vyatta-kdump/internal/log"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	wipeChunkSize   = 1 << 20
+	wipeDirSuffix   = ".wipe"
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// Progress of a secure crash dump deletion
+type WipeProgress struct {
+	Name    string
+	Total   int64
+	Done    int64
+	Started time.Time
+}
+
+var (
+	secureDelete int32
+	wipes        = struct {
+		sync.Mutex
+		entries map[string]*WipeProgress
+	}{entries: make(map[string]*WipeProgress)}
+)
+
+// Set if crash dump files are wiped before they are removed
+func SetSecureDelete(enable bool) {
+	v := int32(0)
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&secureDelete, v)
+}
+
+func SecureDeleteEnabled() bool {
+	return atomic.LoadInt32(&secureDelete) != 0
+}
+
+// Overwrite a file with zeros and release its blocks, so filesystems
+// mounted with discard also discard them on the device, then unlink it
+func wipeFile(fname string, progress func(int64)) error {
+	fi, err := os.Lstat(fname)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return os.Remove(fname)
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	buf := make([]byte, wipeChunkSize)
+	for off := int64(0); off < size; {
+		n := size - off
+		if n > wipeChunkSize {
+			n = wipeChunkSize
+		}
+		if _, err := f.WriteAt(buf[:n], off); err != nil {
+			f.Close()
+			return err
+		}
+		off += n
+		if progress != nil {
+			progress(n)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	// Not all filesystems support punching holes
+	syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, 0, size)
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(fname)
+}
+
+// Remove a file, wiping it first if secure delete is enabled
+func removeFile(fname string) error {
+	if SecureDeleteEnabled() {
+		return wipeFile(fname, nil)
+	}
+	return os.Remove(fname)
+}
+
+func dirSize(dir string) int64 {
+	var total int64
+	dentries, _ := ioutil.ReadDir(dir)
+	for _, d := range dentries {
+		if d.Mode().IsRegular() {
+			total += d.Size()
+		}
+	}
+	return total
+}
+
+// Wipe all files of a crash directory being deleted
+func wipeCrashDir(p *WipeProgress) {
+	dir := fmt.Sprintf("%s/%s%s", kdumpCrashDir, p.Name, wipeDirSuffix)
+	defer func() {
+		wipes.Lock()
+		delete(wipes.entries, p.Name)
+		wipes.Unlock()
+	}()
+
+	log.Ilog.Printf("Securely deleting crash dump %s (%d bytes)", p.Name, p.Total)
+	progress := func(n int64) {
+		wipes.Lock()
+		p.Done += n
+		wipes.Unlock()
+	}
+	dentries, _ := ioutil.ReadDir(dir)
+	for _, d := range dentries {
+		fname := fmt.Sprintf("%s/%s", dir, d.Name())
+		if d.IsDir() {
+			os.RemoveAll(fname)
+			continue
+		}
+		if err := wipeFile(fname, progress); err != nil {
+			log.Elog.Printf("Secure delete %s: %s", fname, err)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Elog.Println("Secure delete:", err)
+		return
+	}
+	log.Ilog.Printf("Crash dump %s securely deleted in %s", p.Name,
+		time.Since(p.Started).Round(time.Second))
+}
+
+func startWipe(name string) {
+	p := &WipeProgress{
+		Name:    name,
+		Total:   dirSize(fmt.Sprintf("%s/%s%s", kdumpCrashDir, name, wipeDirSuffix)),
+		Started: time.Now(),
+	}
+	wipes.Lock()
+	if _, ok := wipes.entries[name]; ok {
+		wipes.Unlock()
+		return
+	}
+	wipes.entries[name] = p
+	wipes.Unlock()
+	go wipeCrashDir(p)
+}
+
+// Delete a crash dump, overwriting its files before unlinking them. The
+// crash directory is renamed so the crash dump is no longer listed, and
+// its files are wiped in the background.
+func SecureDelCrashDump(crashdump os.FileInfo) error {
+	name := crashdump.Name()
+	dname := fmt.Sprintf("%s/%s", kdumpCrashDir, name)
+	if err := os.Rename(dname, dname+wipeDirSuffix); err != nil {
+		log.Ilog.Printf("SecureDelCrashDump: %s\n", err)
+		return err
+	}
+	forgetCrashDump(name)
+	startWipe(name)
+	return nil
+}
+
+// Restart secure deletions interrupted by a restart of the service
+func ResumeSecureDelete() {
+	dentries, err := ioutil.ReadDir(kdumpCrashDir)
+	if err != nil {
+		return
+	}
+	for _, d := range dentries {
+		if d.IsDir() && strings.HasSuffix(d.Name(), wipeDirSuffix) {
+			startWipe(strings.TrimSuffix(d.Name(), wipeDirSuffix))
+		}
+	}
+}
+
+// Secure deletions in progress
+func GetSecureDeletes() []WipeProgress {
+	wipes.Lock()
+	defer wipes.Unlock()
+	res := make([]WipeProgress, 0, len(wipes.entries))
+	for _, p := range wipes.entries {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
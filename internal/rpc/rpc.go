@@ -2,15 +2,251 @@
 // SPDX-License-Identifier: GPL-2.0-only
 package rpc
 
+import (
+	st "github.com/danos/vyatta-kdump/internal/state"
+)
+
 type RPCInput struct {
-	Index []int32 `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	Index []int32  `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	ID    []string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+}
+
+type DeleteInput struct {
+	Index  []int32  `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	ID     []string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+	Secure bool     `rfc7951:"vyatta-system-crash-dump-v1:secure,emptyleaf"`
+	Force  bool     `rfc7951:"vyatta-system-crash-dump-v1:force,emptyleaf"`
 }
+type DMesgInput struct {
+	Index        []int32  `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	ID           []string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+	Symbolize    bool     `rfc7951:"vyatta-system-crash-dump-v1:symbolize,emptyleaf"`
+	Tail         uint32   `rfc7951:"vyatta-system-crash-dump-v1:tail,omitempty"`
+	Level        string   `rfc7951:"vyatta-system-crash-dump-v1:level,omitempty"`
+	Match        string   `rfc7951:"vyatta-system-crash-dump-v1:match,omitempty"`
+	WindowBefore *uint32  `rfc7951:"vyatta-system-crash-dump-v1:window-before,omitempty"`
+	WindowAfter  *uint32  `rfc7951:"vyatta-system-crash-dump-v1:window-after,omitempty"`
+	Offset       uint32   `rfc7951:"vyatta-system-crash-dump-v1:offset,omitempty"`
+	Limit        uint32   `rfc7951:"vyatta-system-crash-dump-v1:limit,omitempty"`
+}
+
 type CrashData struct {
-	Index    int32  `rfc7951:"index"`
-	FileName string `rfc7951:"filename"`
-	DMesg    string `rfc7951:"dmesg"`
+	Index             int32  `rfc7951:"index"`
+	ID                string `rfc7951:"id,omitempty"`
+	FileName          string `rfc7951:"filename"`
+	DMesg             string `rfc7951:"dmesg"`
+	DMesgSource       string `rfc7951:"dmesg-source,omitempty"`
+	TotalLines        uint32 `rfc7951:"total-lines,omitempty"`
+	MatchedLines      uint32 `rfc7951:"matched-lines,omitempty"`
+	UnknownLevelLines uint32 `rfc7951:"unknown-level-lines,omitempty"`
 }
 
 type CrashDMesgOut struct {
 	CrashInfo []CrashData `rfc7951:"vyatta-system-crash-dump-v1:crash-info"`
 }
+
+type CrashAnalysisInfo struct {
+	Index    int32                 `rfc7951:"index"`
+	ID       string                `rfc7951:"id,omitempty"`
+	FileName string                `rfc7951:"filename,omitempty"`
+	Analysis *st.CrashAnalysisData `rfc7951:"analysis,omitempty"`
+}
+
+type CrashAnalysisOut struct {
+	CrashAnalysis []CrashAnalysisInfo `rfc7951:"vyatta-system-crash-dump-v1:crash-analysis"`
+}
+
+type KnownIssueMatch struct {
+	Index    int32  `rfc7951:"index"`
+	FileName string `rfc7951:"filename,omitempty"`
+	BugID    string `rfc7951:"bug-id"`
+}
+
+type KnownIssuesOut struct {
+	KnownIssues uint32            `rfc7951:"vyatta-system-crash-dump-v1:known-issues"`
+	Matches     []KnownIssueMatch `rfc7951:"vyatta-system-crash-dump-v1:crash-dump"`
+}
+
+type CrashToolInput struct {
+	Index    *int32   `rfc7951:"vyatta-system-crash-dump-v1:index,omitempty"`
+	ID       string   `rfc7951:"vyatta-system-crash-dump-v1:id,omitempty"`
+	Commands []string `rfc7951:"vyatta-system-crash-dump-v1:command,omitempty"`
+	Refresh  bool     `rfc7951:"vyatta-system-crash-dump-v1:refresh,emptyleaf"`
+}
+
+type CrashCommandOutput struct {
+	Sequence uint32 `rfc7951:"sequence"`
+	Command  string `rfc7951:"command"`
+	Output   string `rfc7951:"output"`
+}
+
+type CrashToolOut struct {
+	FileName string               `rfc7951:"vyatta-system-crash-dump-v1:filename"`
+	Vmlinux  string               `rfc7951:"vyatta-system-crash-dump-v1:vmlinux"`
+	Time     string               `rfc7951:"vyatta-system-crash-dump-v1:time"`
+	Outputs  []CrashCommandOutput `rfc7951:"vyatta-system-crash-dump-v1:command-output"`
+}
+
+type CrashReportInput struct {
+	Index *int32 `rfc7951:"vyatta-system-crash-dump-v1:index,omitempty"`
+	ID    string `rfc7951:"vyatta-system-crash-dump-v1:id,omitempty"`
+}
+
+type CrashReportOut struct {
+	FileName     string `rfc7951:"vyatta-system-crash-dump-v1:filename"`
+	JSONFile     string `rfc7951:"vyatta-system-crash-dump-v1:json-report"`
+	MarkdownFile string `rfc7951:"vyatta-system-crash-dump-v1:markdown-report"`
+	HTMLFile     string `rfc7951:"vyatta-system-crash-dump-v1:html-report"`
+	Report       string `rfc7951:"vyatta-system-crash-dump-v1:report"`
+}
+
+type FileIntegrity struct {
+	Name     string `rfc7951:"name"`
+	Status   string `rfc7951:"status"`
+	Expected string `rfc7951:"expected,omitempty"`
+	Actual   string `rfc7951:"actual,omitempty"`
+}
+
+type CrashIntegrity struct {
+	Index     int32           `rfc7951:"index"`
+	ID        string          `rfc7951:"id,omitempty"`
+	FileName  string          `rfc7951:"filename,omitempty"`
+	Integrity string          `rfc7951:"integrity,omitempty"`
+	Error     string          `rfc7951:"error,omitempty"`
+	Files     []FileIntegrity `rfc7951:"file,omitempty"`
+}
+
+type VerifyOut struct {
+	CrashDumps []CrashIntegrity `rfc7951:"vyatta-system-crash-dump-v1:crash-dump"`
+}
+
+type SalvageInput struct {
+	Index *int32 `rfc7951:"vyatta-system-crash-dump-v1:index,omitempty"`
+	ID    string `rfc7951:"vyatta-system-crash-dump-v1:id,omitempty"`
+}
+
+type SalvageOut struct {
+	FileName        string `rfc7951:"vyatta-system-crash-dump-v1:filename"`
+	Incomplete      string `rfc7951:"vyatta-system-crash-dump-v1:incomplete-reason,omitempty"`
+	VMCoreInfo      bool   `rfc7951:"vyatta-system-crash-dump-v1:vmcoreinfo-salvaged"`
+	VMCoreInfoError string `rfc7951:"vyatta-system-crash-dump-v1:vmcoreinfo-error,omitempty"`
+	DMesgLines      uint32 `rfc7951:"vyatta-system-crash-dump-v1:dmesg-lines"`
+	DMesgError      string `rfc7951:"vyatta-system-crash-dump-v1:dmesg-error,omitempty"`
+}
+
+type CleanupInput struct {
+	DryRun bool `rfc7951:"vyatta-system-crash-dump-v1:dry-run,emptyleaf"`
+}
+
+type CleanupEntry struct {
+	Path   string `rfc7951:"path"`
+	Size   uint64 `rfc7951:"size"`
+	Reason string `rfc7951:"reason"`
+	Kept   bool   `rfc7951:"kept"`
+}
+
+type CleanupOut struct {
+	Entries    []CleanupEntry `rfc7951:"vyatta-system-crash-dump-v1:entry,omitempty"`
+	TotalBytes uint64         `rfc7951:"vyatta-system-crash-dump-v1:total-bytes"`
+	Error      string         `rfc7951:"vyatta-system-crash-dump-v1:error,omitempty"`
+}
+
+type CrashInfoInput struct {
+	Index []int32  `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	ID    []string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+}
+
+type CrashFile struct {
+	Name string `rfc7951:"name"`
+	Size uint64 `rfc7951:"size"`
+}
+
+type Checksum struct {
+	File   string `rfc7951:"file"`
+	SHA256 string `rfc7951:"sha256"`
+}
+
+type CrashInfo struct {
+	Index            int32       `rfc7951:"index"`
+	ID               string      `rfc7951:"id,omitempty"`
+	FileName         string      `rfc7951:"filename,omitempty"`
+	Format           string      `rfc7951:"format,omitempty"`
+	DumpLevel        *uint32     `rfc7951:"dump-level,omitempty"`
+	Compression      string      `rfc7951:"compression,omitempty"`
+	KernelRelease    string      `rfc7951:"kernel-release,omitempty"`
+	BuildID          string      `rfc7951:"build-id,omitempty"`
+	Timestamp        string      `rfc7951:"timestamp,omitempty"`
+	CrashTime        string      `rfc7951:"crash-time,omitempty"`
+	PanicMessage     string      `rfc7951:"panic-message,omitempty"`
+	Signature        string      `rfc7951:"signature,omitempty"`
+	Encrypted        bool        `rfc7951:"encrypted"`
+	IncompleteReason string      `rfc7951:"incomplete-reason,omitempty"`
+	Integrity        string      `rfc7951:"integrity,omitempty"`
+	VerifiedTime     string      `rfc7951:"verified-time,omitempty"`
+	Checksums        []Checksum  `rfc7951:"checksum,omitempty"`
+	Notes            string      `rfc7951:"notes,omitempty"`
+	Pinned           bool        `rfc7951:"pinned"`
+	ImportedFrom     string      `rfc7951:"imported-from,omitempty"`
+	ImportDesc       string      `rfc7951:"import-description,omitempty"`
+	ImportTime       string      `rfc7951:"import-time,omitempty"`
+	Files            []CrashFile `rfc7951:"file,omitempty"`
+}
+
+type CrashInfoOut struct {
+	CrashDumps []CrashInfo `rfc7951:"vyatta-system-crash-dump-v1:crash-dump"`
+}
+
+type DumpInput struct {
+	Index *int32 `rfc7951:"vyatta-system-crash-dump-v1:index,omitempty"`
+	ID    string `rfc7951:"vyatta-system-crash-dump-v1:id,omitempty"`
+}
+
+type NotesInput struct {
+	Index *int32 `rfc7951:"vyatta-system-crash-dump-v1:index,omitempty"`
+	ID    string `rfc7951:"vyatta-system-crash-dump-v1:id,omitempty"`
+	Notes string `rfc7951:"vyatta-system-crash-dump-v1:notes"`
+}
+
+type ExportInput struct {
+	Index       []int32  `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	ID          []string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+	Destination string   `rfc7951:"vyatta-system-crash-dump-v1:destination"`
+	Compression string   `rfc7951:"vyatta-system-crash-dump-v1:compression,omitempty"`
+}
+
+type ExportOut struct {
+	Archive    string `rfc7951:"vyatta-system-crash-dump-v1:archive"`
+	TotalBytes uint64 `rfc7951:"vyatta-system-crash-dump-v1:total-bytes"`
+}
+
+type UploadInput struct {
+	Index       []int32  `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	ID          []string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+	Destination string   `rfc7951:"vyatta-system-crash-dump-v1:destination"`
+	Bundle      bool     `rfc7951:"vyatta-system-crash-dump-v1:bundle,emptyleaf"`
+	Compression string   `rfc7951:"vyatta-system-crash-dump-v1:compression,omitempty"`
+}
+
+type UploadOut struct {
+	UploadID string `rfc7951:"vyatta-system-crash-dump-v1:upload-id"`
+}
+
+type QueueItemInput struct {
+	ID string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+}
+
+type ImportInput struct {
+	Path        string `rfc7951:"vyatta-system-crash-dump-v1:path"`
+	Description string `rfc7951:"vyatta-system-crash-dump-v1:description,omitempty"`
+}
+
+type ImportOut struct {
+	Index         int32  `rfc7951:"vyatta-system-crash-dump-v1:index"`
+	ID            string `rfc7951:"vyatta-system-crash-dump-v1:id"`
+	FileName      string `rfc7951:"vyatta-system-crash-dump-v1:filename"`
+	Format        string `rfc7951:"vyatta-system-crash-dump-v1:format"`
+	KernelRelease string `rfc7951:"vyatta-system-crash-dump-v1:kernel-release,omitempty"`
+	Incomplete    string `rfc7951:"vyatta-system-crash-dump-v1:incomplete-reason,omitempty"`
+	DMesgLines    uint32 `rfc7951:"vyatta-system-crash-dump-v1:dmesg-lines"`
+	DMesgError    string `rfc7951:"vyatta-system-crash-dump-v1:dmesg-error,omitempty"`
+}
@@ -8,11 +8,113 @@ type KDumpStatusData struct {
 	NeedReboot        bool            `rfc7951:"need-reboot"`
 	CrashRebootStatus bool            `rfc7951:"rebooted-after-system-crash,omitempty"`
 	CrashDumps        []CrashDumpData `rfc7951:"crash-dump-files"`
+	SecureDeletes     []SecureDelete  `rfc7951:"secure-delete,omitempty"`
+	OrphanedEntries   []OrphanedEntry `rfc7951:"orphaned-entry,omitempty"`
+	Exports           []Export        `rfc7951:"export,omitempty"`
+	Uploads           []Upload        `rfc7951:"upload,omitempty"`
+	UploadQueue       []QueueItem     `rfc7951:"upload-queue,omitempty"`
+}
+
+type OrphanedEntry struct {
+	Path   string `rfc7951:"path"`
+	Size   uint64 `rfc7951:"size"`
+	Reason string `rfc7951:"reason"`
+	Kept   bool   `rfc7951:"kept"`
+}
+
+type Export struct {
+	Archive   string `rfc7951:"archive"`
+	Total     uint64 `rfc7951:"total-bytes"`
+	Written   uint64 `rfc7951:"written-bytes"`
+	Percent   uint8  `rfc7951:"percent-complete"`
+	StartTime string `rfc7951:"start-time"`
+	Status    string `rfc7951:"status"`
+	Error     string `rfc7951:"error,omitempty"`
+}
+
+type Upload struct {
+	ID          string       `rfc7951:"id"`
+	Destination string       `rfc7951:"destination"`
+	CrashDumps  []string     `rfc7951:"crash-dump"`
+	Bundle      bool         `rfc7951:"bundle"`
+	StartTime   string       `rfc7951:"start-time"`
+	Status      string       `rfc7951:"status"`
+	Error       string       `rfc7951:"error,omitempty"`
+	Files       []UploadFile `rfc7951:"file,omitempty"`
+}
+
+type QueueItem struct {
+	ID          string `rfc7951:"id"`
+	CrashDump   string `rfc7951:"crash-dump"`
+	Destination string `rfc7951:"destination"`
+	Content     string `rfc7951:"content"`
+	Status      string `rfc7951:"status"`
+	Attempts    uint32 `rfc7951:"attempts"`
+	AddTime     string `rfc7951:"add-time"`
+	LastAttempt string `rfc7951:"last-attempt-time,omitempty"`
+	NextAttempt string `rfc7951:"next-attempt-time,omitempty"`
+	Error       string `rfc7951:"error,omitempty"`
+	UploadID    string `rfc7951:"upload-id,omitempty"`
+}
+
+type UploadFile struct {
+	Remote   string `rfc7951:"name"`
+	Size     uint64 `rfc7951:"size"`
+	SHA256   string `rfc7951:"sha256,omitempty"`
+	Status   string `rfc7951:"status"`
+	Resumed  bool   `rfc7951:"resumed"`
+	Verified bool   `rfc7951:"verified"`
+	Error    string `rfc7951:"error,omitempty"`
+}
+
+type SecureDelete struct {
+	Name      string `rfc7951:"name"`
+	Total     uint64 `rfc7951:"total-bytes"`
+	Wiped     uint64 `rfc7951:"wiped-bytes"`
+	Percent   uint8  `rfc7951:"percent-complete"`
+	StartTime string `rfc7951:"start-time"`
 }
 
 type CrashDumpData struct {
-	Index     uint32 `rfc7951:"index"`
-	Timestamp string `rfc7951:"timestamp,omitempty"`
-	Path      string `rfc7951:"path,omitempty"`
-	Size      uint64 `rfc7951:"size,omitempty"`
+	Index            uint32             `rfc7951:"index"`
+	ID               string             `rfc7951:"id"`
+	Timestamp        string             `rfc7951:"timestamp,omitempty"`
+	Path             string             `rfc7951:"path,omitempty"`
+	Size             uint64             `rfc7951:"size,omitempty"`
+	KernelRelease    string             `rfc7951:"kernel-release,omitempty"`
+	BuildID          string             `rfc7951:"build-id,omitempty"`
+	PageSize         uint32             `rfc7951:"page-size,omitempty"`
+	CrashTime        string             `rfc7951:"crash-time,omitempty"`
+	PanicCPU         *uint32            `rfc7951:"panic-cpu,omitempty"`
+	Signature        string             `rfc7951:"signature,omitempty"`
+	Symbols          bool               `rfc7951:"symbols-available"`
+	Encrypted        bool               `rfc7951:"encrypted"`
+	Incomplete       bool               `rfc7951:"incomplete"`
+	IncompleteReason string             `rfc7951:"incomplete-reason,omitempty"`
+	Integrity        string             `rfc7951:"integrity,omitempty"`
+	VerifiedTime     string             `rfc7951:"verified-time,omitempty"`
+	Pinned           bool               `rfc7951:"pinned"`
+	Notes            string             `rfc7951:"notes,omitempty"`
+	ImportedFrom     string             `rfc7951:"imported-from,omitempty"`
+	Analysis         *CrashAnalysisData `rfc7951:"analysis,omitempty"`
+	KnownIssue       *KnownIssueData    `rfc7951:"known-issue,omitempty"`
+}
+
+type KnownIssueData struct {
+	BugID  string `rfc7951:"bug-id"`
+	Title  string `rfc7951:"title,omitempty"`
+	Advice string `rfc7951:"advice,omitempty"`
+}
+
+type CrashAnalysisData struct {
+	PanicMessage       string   `rfc7951:"panic-message,omitempty"`
+	OopsType           string   `rfc7951:"oops-type,omitempty"`
+	InstructionPointer string   `rfc7951:"instruction-pointer,omitempty"`
+	Task               string   `rfc7951:"task,omitempty"`
+	PID                *uint32  `rfc7951:"pid,omitempty"`
+	CPU                *uint32  `rfc7951:"cpu,omitempty"`
+	CallTrace          []string `rfc7951:"call-trace,omitempty"`
+	Tainted            string   `rfc7951:"tainted,omitempty"`
+	TaintFlags         []string `rfc7951:"taint-flags,omitempty"`
+	HardwareErrors     []string `rfc7951:"hardware-errors,omitempty"`
 }
@@ -4,9 +4,13 @@ package vci_kdump
 
 import (
 	"fmt"
+	"github.com/danos/encoding/rfc7951"
 	"github.com/danos/vyatta-kdump/internal/kdump"
+	"github.com/danos/vyatta-kdump/internal/log"
 	rpc "github.com/danos/vyatta-kdump/internal/rpc"
 	"os"
+	"regexp"
+	"time"
 )
 
 type RPC struct {
@@ -19,12 +23,21 @@ func RPCNew(conf *Config) *RPC {
 	}
 }
 
-func (r *RPC) DeleteCrashDumps(in rpc.RPCInput) (struct{}, error) {
+func (r *RPC) DeleteCrashDumps(in rpc.DeleteInput) (struct{}, error) {
 	_, crashdumps := kdump.GetCrashFiles()
-	if len(in.Index) == 0 {
+	del := kdump.DelCrashDump
+	if in.Secure || kdump.SecureDeleteEnabled() {
+		del = kdump.SecureDelCrashDump
+	}
+	if len(in.Index) == 0 && len(in.ID) == 0 {
 		for _, dump := range crashdumps {
-			kdump.DelCrashDump(dump)
+			if !in.Force && kdump.IsPinned(dump) {
+				log.Ilog.Printf("Not deleting pinned crash dump %s", dump.Name())
+				continue
+			}
+			del(dump)
 		}
+		kdump.PruneKernelSymbols()
 		return struct{}{}, nil
 	}
 
@@ -41,26 +54,40 @@ func (r *RPC) DeleteCrashDumps(in rpc.RPCInput) (struct{}, error) {
 	if len(bad_index) != 0 {
 		return struct{}{}, fmt.Errorf("DeleteCrashDumps bad input: %v", bad_index)
 	}
+	bad_id := make([]string, 0)
+	for _, id := range in.ID {
+		n := dumpByID(id, crashdumps)
+		if n < 0 {
+			bad_id = append(bad_id, id)
+		} else {
+			dumps_to_delete = append(dumps_to_delete, crashdumps[n])
+		}
+	}
+	if len(bad_id) != 0 {
+		return struct{}{}, fmt.Errorf("DeleteCrashDumps unknown crash dump: %v", bad_id)
+	}
 	for _, d := range dumps_to_delete {
-		kdump.DelCrashDump(d)
+		del(d)
 	}
+	kdump.PruneKernelSymbols()
 	return struct{}{}, nil
 }
 
-func (r *RPC) GetCrashDmesg(in rpc.RPCInput) (*rpc.CrashDMesgOut, error) {
+func (r *RPC) GetCrashDmesg(in rpc.DMesgInput) (*rpc.CrashDMesgOut, error) {
 	crash_dir, crashdumps := kdump.GetCrashFiles()
 
+	index, err := dumpSelection(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, fmt.Errorf("GetCrashDmesg %s", err)
+	}
+	filter, err := dmesgFilter(in)
+	if err != nil {
+		return nil, fmt.Errorf("GetCrashDmesg: %s", err)
+	}
 	res := &rpc.CrashDMesgOut{}
-	if len(in.Index) != 0 {
-		res.CrashInfo = make([]rpc.CrashData, len(in.Index))
-		for i, index := range in.Index {
-			res.CrashInfo[i].Index = index
-		}
-	} else {
-		res.CrashInfo = make([]rpc.CrashData, len(crashdumps))
-		for i := 0; i < len(crashdumps); i++ {
-			res.CrashInfo[i].Index = int32(i)
-		}
+	res.CrashInfo = make([]rpc.CrashData, len(index))
+	for i, idx := range index {
+		res.CrashInfo[i].Index = idx
 	}
 
 	for i := 0; i < len(res.CrashInfo); i++ {
@@ -68,12 +95,507 @@ func (r *RPC) GetCrashDmesg(in rpc.RPCInput) (*rpc.CrashDMesgOut, error) {
 		if err != nil {
 			continue
 		}
+		res.CrashInfo[i].ID = crashdumps[n].Name()
 		res.CrashInfo[i].FileName = fmt.Sprintf("%s/%s", crash_dir, crashdumps[n].Name())
-		res.CrashInfo[i].DMesg = kdump.GetCrashDMsg(crashdumps[n])
+		res.CrashInfo[i].DMesg, res.CrashInfo[i].DMesgSource = kdump.GetCrashDMsg(crashdumps[n])
+		if !filter.IsEmpty() {
+			var levels map[string]int
+			if filter.Level >= 0 {
+				levels = kdump.CrashDMesgLevels(crashdumps[n].Name())
+			}
+			page := kdump.FilterDMesg(res.CrashInfo[i].DMesg, filter, levels)
+			res.CrashInfo[i].DMesg = page.DMesg
+			res.CrashInfo[i].TotalLines = uint32(page.TotalLines)
+			res.CrashInfo[i].MatchedLines = uint32(page.MatchedLines)
+			res.CrashInfo[i].UnknownLevelLines = uint32(page.UnknownLevel)
+		}
+		if in.Symbolize {
+			dmesg, err := kdump.SymbolizeDMesg(crashdumps[n], res.CrashInfo[i].DMesg)
+			if err != nil {
+				log.Wlog.Printf("Symbolize %s: %s", crashdumps[n].Name(), err)
+			}
+			res.CrashInfo[i].DMesg = dmesg
+		}
+	}
+	return res, nil
+}
+
+func dmesgFilter(in rpc.DMesgInput) (*kdump.DMesgFilter, error) {
+	f := &kdump.DMesgFilter{
+		Level:  -1,
+		Tail:   int(in.Tail),
+		Offset: int(in.Offset),
+		Limit:  int(in.Limit),
+	}
+	if in.Level != "" {
+		level, ok := kdump.LogLevel(in.Level)
+		if !ok {
+			return nil, fmt.Errorf("unknown log level %s", in.Level)
+		}
+		f.Level = level
+	}
+	if in.Match != "" {
+		re, err := regexp.Compile(in.Match)
+		if err != nil {
+			return nil, err
+		}
+		f.Match = re
+	}
+	if in.WindowBefore != nil {
+		f.Window = true
+		f.Before = float64(*in.WindowBefore)
+	}
+	if in.WindowAfter != nil {
+		f.Window = true
+		f.After = float64(*in.WindowAfter)
+	}
+	return f, nil
+}
+
+func (r *RPC) GetCrashAnalysis(in rpc.RPCInput) (*rpc.CrashAnalysisOut, error) {
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	index, err := dumpSelection(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, fmt.Errorf("GetCrashAnalysis %s", err)
+	}
+
+	res := &rpc.CrashAnalysisOut{}
+	res.CrashAnalysis = make([]rpc.CrashAnalysisInfo, len(index))
+	for i, idx := range index {
+		res.CrashAnalysis[i].Index = idx
+		n, err := dumpIndex(idx, len(crashdumps))
+		if err != nil {
+			continue
+		}
+		res.CrashAnalysis[i].ID = crashdumps[n].Name()
+		res.CrashAnalysis[i].FileName = fmt.Sprintf("%s/%s", crash_dir, crashdumps[n].Name())
+		res.CrashAnalysis[i].Analysis = analysisData(kdump.GetCrashAnalysis(crashdumps[n]))
+	}
+	return res, nil
+}
+
+// Reload the known issues file and match all crash dumps against it
+func (r *RPC) ReloadKnownIssues(in struct{}) (*rpc.KnownIssuesOut, error) {
+	n, err := kdump.LoadKnownIssues()
+	if err != nil {
+		return nil, fmt.Errorf("ReloadKnownIssues: %s", err)
+	}
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	res := &rpc.KnownIssuesOut{
+		KnownIssues: uint32(n),
+		Matches:     make([]rpc.KnownIssueMatch, 0),
+	}
+	for i, cd := range crashdumps {
+		if ki := kdump.MatchKnownIssue(cd); ki != nil {
+			res.Matches = append(res.Matches, rpc.KnownIssueMatch{
+				Index:    int32(i),
+				FileName: fmt.Sprintf("%s/%s", crash_dir, cd.Name()),
+				BugID:    ki.BugID,
+			})
+		}
+	}
+	return res, nil
+}
+
+// Run crash utility commands against a crash dump
+func (r *RPC) RunCrashCommands(in rpc.CrashToolInput) (*rpc.CrashToolOut, error) {
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	n, err := selectDump(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, err
+	}
+	commands := in.Commands
+	if len(commands) == 0 && r.conf != nil {
+		if kd := r.conf.Get().System.KDump; kd != nil {
+			commands = kd.CrashCommands
+		}
+	}
+	result, err := kdump.RunCrashTool(crashdumps[n], commands, in.Refresh)
+	if err != nil {
+		return nil, fmt.Errorf("RunCrashCommands: %s", err)
+	}
+	res := &rpc.CrashToolOut{
+		FileName: fmt.Sprintf("%s/%s", crash_dir, crashdumps[n].Name()),
+		Vmlinux:  result.Vmlinux,
+		Time:     result.Time.Format(time.RFC3339),
+		Outputs:  make([]rpc.CrashCommandOutput, len(result.Commands)),
+	}
+	for i, c := range result.Commands {
+		res.Outputs[i] = rpc.CrashCommandOutput{
+			Sequence: uint32(i),
+			Command:  c.Command,
+			Output:   c.Output,
+		}
+	}
+	return res, nil
+}
+
+// Generate a crash report for a crash dump in the crash directory
+func (r *RPC) GenerateCrashReport(in rpc.CrashReportInput) (*rpc.CrashReportOut, error) {
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	n, err := selectDump(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, err
+	}
+	config := r.configJSON("GenerateCrashReport")
+	report := kdump.GenerateCrashReport(crashdumps[n], config)
+	md, err := kdump.WriteCrashReport(report)
+	if err != nil {
+		return nil, fmt.Errorf("GenerateCrashReport: %s", err)
+	}
+	res := &rpc.CrashReportOut{
+		FileName: fmt.Sprintf("%s/%s", crash_dir, crashdumps[n].Name()),
+		Report:   md,
+	}
+	res.JSONFile, res.MarkdownFile, res.HTMLFile = kdump.CrashReportFiles(crashdumps[n].Name())
+	return res, nil
+}
+
+// Verify crash dump files against their checksum manifests
+func (r *RPC) VerifyCrashDumps(in rpc.RPCInput) (*rpc.VerifyOut, error) {
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	index, err := dumpSelection(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, fmt.Errorf("VerifyCrashDumps %s", err)
+	}
+
+	res := &rpc.VerifyOut{}
+	res.CrashDumps = make([]rpc.CrashIntegrity, len(index))
+	for i, idx := range index {
+		cd := &res.CrashDumps[i]
+		cd.Index = idx
+		n, err := dumpIndex(idx, len(crashdumps))
+		if err != nil {
+			continue
+		}
+		cd.ID = crashdumps[n].Name()
+		cd.FileName = fmt.Sprintf("%s/%s", crash_dir, crashdumps[n].Name())
+		status, files, err := kdump.VerifyCrashDump(crashdumps[n])
+		if err != nil {
+			cd.Error = err.Error()
+			continue
+		}
+		cd.Integrity = status
+		cd.Files = make([]rpc.FileIntegrity, len(files))
+		for j, f := range files {
+			cd.Files[j] = rpc.FileIntegrity{
+				Name:     f.File,
+				Status:   f.Status,
+				Expected: f.Expected,
+				Actual:   f.Actual,
+			}
+		}
+	}
+	return res, nil
+}
+
+// Recover the kernel log and VMCOREINFO from an incomplete crash dump
+func (r *RPC) SalvageCrashDump(in rpc.SalvageInput) (*rpc.SalvageOut, error) {
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	n, err := selectDump(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, err
+	}
+	result, err := kdump.SalvageCrashDump(crashdumps[n])
+	if err != nil {
+		return nil, fmt.Errorf("SalvageCrashDump: %s", err)
+	}
+	return &rpc.SalvageOut{
+		FileName:        fmt.Sprintf("%s/%s", crash_dir, crashdumps[n].Name()),
+		Incomplete:      result.Incomplete,
+		VMCoreInfo:      result.VMCoreInfo,
+		VMCoreInfoError: result.VMCoreError,
+		DMesgLines:      uint32(result.DMesgLines),
+		DMesgError:      result.DMesgError,
+	}, nil
+}
+
+// Import a crash dump from another system or a virtual machine into the
+// crash directory
+func (r *RPC) ImportCrashDump(in rpc.ImportInput) (*rpc.ImportOut, error) {
+	result, err := kdump.ImportCrashDump(in.Path, in.Description)
+	if err != nil {
+		return nil, fmt.Errorf("ImportCrashDump: %s", err)
+	}
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	out := &rpc.ImportOut{
+		Index:      int32(dumpByID(result.Name, crashdumps)),
+		ID:         result.Name,
+		FileName:   fmt.Sprintf("%s/%s", crash_dir, result.Name),
+		Format:     result.Format,
+		Incomplete: result.Incomplete,
+		DMesgLines: uint32(result.DMesgLines),
+		DMesgError: result.DMesgError,
+	}
+	if result.VMCoreInfo != nil {
+		out.KernelRelease = result.VMCoreInfo.KernelRelease
+	}
+	return out, nil
+}
+
+func (r *RPC) CleanupCrashDirectory(in rpc.CleanupInput) (*rpc.CleanupOut, error) {
+	out := &rpc.CleanupOut{}
+	removed, err := kdump.CleanupCrashDir(in.DryRun)
+	if err != nil {
+		out.Error = err.Error()
+	}
+	out.Entries = make([]rpc.CleanupEntry, len(removed))
+	for i, o := range removed {
+		out.Entries[i] = rpc.CleanupEntry{
+			Path:   o.Path,
+			Size:   uint64(o.Size),
+			Reason: o.Reason,
+			Kept:   o.Kept,
+		}
+		if !o.Kept {
+			out.TotalBytes += uint64(o.Size)
+		}
+	}
+	return out, nil
+}
+
+// Get the details of crash dumps
+func (r *RPC) GetCrashInfo(in rpc.CrashInfoInput) (*rpc.CrashInfoOut, error) {
+	crash_dir, crashdumps := kdump.GetCrashFiles()
+	index, err := dumpSelection(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, fmt.Errorf("GetCrashInfo %s", err)
+	}
+	res := &rpc.CrashInfoOut{
+		CrashDumps: make([]rpc.CrashInfo, len(index)),
+	}
+	for i, idx := range index {
+		cd := &res.CrashDumps[i]
+		cd.Index = idx
+		n, err := dumpIndex(idx, len(crashdumps))
+		if err != nil {
+			continue
+		}
+		ci := kdump.GetCrashInfo(crashdumps[n])
+		cd.ID = ci.Name
+		cd.FileName = fmt.Sprintf("%s/%s", crash_dir, ci.Name)
+		cd.Format = ci.Format
+		cd.DumpLevel = optUint32(ci.DumpLevel)
+		cd.Compression = ci.Compression
+		cd.Timestamp = dateTimeFromName(ci.Name, 0)
+		if vmi := ci.VMCoreInfo; vmi != nil {
+			cd.KernelRelease = vmi.KernelRelease
+			cd.BuildID = vmi.BuildID
+			cd.Timestamp = dateTimeFromName(ci.Name, vmi.CrashTime)
+			if vmi.CrashTime != 0 {
+				cd.CrashTime = cd.Timestamp
+			}
+		}
+		cd.PanicMessage = ci.PanicMessage
+		cd.Signature = ci.Signature
+		cd.Encrypted = ci.Encrypted
+		cd.IncompleteReason = ci.Incomplete
+		cd.Integrity = ci.Integrity
+		cd.VerifiedTime = ci.Verified
+		cd.Notes = ci.Notes
+		cd.Pinned = ci.Pinned
+		if ci.Imported != nil {
+			cd.ImportedFrom = ci.Imported.Path
+			cd.ImportDesc = ci.Imported.Description
+			cd.ImportTime = ci.Imported.Time
+		}
+		for _, c := range ci.Checksums {
+			cd.Checksums = append(cd.Checksums, rpc.Checksum{File: c.File, SHA256: c.SHA256})
+		}
+		for _, f := range ci.Files {
+			cd.Files = append(cd.Files, rpc.CrashFile{Name: f.Name, Size: uint64(f.Size)})
+		}
 	}
 	return res, nil
 }
 
+// Protect a crash dump from deletion
+func (r *RPC) PinCrashDump(in rpc.DumpInput) (struct{}, error) {
+	_, crashdumps := kdump.GetCrashFiles()
+	n, err := selectDump(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return struct{}{}, err
+	}
+	if err := kdump.SetPinned(crashdumps[n], true); err != nil {
+		return struct{}{}, fmt.Errorf("PinCrashDump: %s", err)
+	}
+	return struct{}{}, nil
+}
+
+func (r *RPC) UnpinCrashDump(in rpc.DumpInput) (struct{}, error) {
+	_, crashdumps := kdump.GetCrashFiles()
+	n, err := selectDump(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return struct{}{}, err
+	}
+	if err := kdump.SetPinned(crashdumps[n], false); err != nil {
+		return struct{}{}, fmt.Errorf("UnpinCrashDump: %s", err)
+	}
+	return struct{}{}, nil
+}
+
+func (r *RPC) SetCrashDumpNotes(in rpc.NotesInput) (struct{}, error) {
+	_, crashdumps := kdump.GetCrashFiles()
+	n, err := selectDump(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return struct{}{}, err
+	}
+	if err := kdump.SetNotes(crashdumps[n], in.Notes); err != nil {
+		return struct{}{}, fmt.Errorf("SetCrashDumpNotes: %s", err)
+	}
+	return struct{}{}, nil
+}
+
+// Crash dumps selected by index and by ID
+func selectedDumps(index []int32, ids []string, crashdumps []os.FileInfo) ([]os.FileInfo, error) {
+	sel, err := dumpSelection(index, ids, crashdumps)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]os.FileInfo, 0, len(sel))
+	for _, idx := range sel {
+		n, err := dumpIndex(idx, len(crashdumps))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, crashdumps[n])
+	}
+	return res, nil
+}
+
+// Configuration for crash reports and archives, without upload credentials
+func (r *RPC) configJSON(rpcname string) []byte {
+	if r.conf == nil {
+		return nil
+	}
+	conf := *r.conf.Get()
+	conf.System.KDump = conf.System.KDump.Redacted()
+	config, err := rfc7951.Marshal(&conf)
+	if err != nil {
+		log.Wlog.Println(rpcname+": configuration:", err)
+	}
+	return config
+}
+
+// Export crash dumps to an archive at a local path. The archive is written
+// in the background; its progress is shown in the state.
+func (r *RPC) ExportCrashDumps(in rpc.ExportInput) (*rpc.ExportOut, error) {
+	_, crashdumps := kdump.GetCrashFiles()
+	sel, err := selectedDumps(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, fmt.Errorf("ExportCrashDumps: %s", err)
+	}
+	config := r.configJSON("ExportCrashDumps")
+	p, err := kdump.ExportCrashDumps(sel, in.Destination, in.Compression, config)
+	if err != nil {
+		return nil, fmt.Errorf("ExportCrashDumps: %s", err)
+	}
+	return &rpc.ExportOut{Archive: p.Archive, TotalBytes: uint64(p.Total)}, nil
+}
+
+// Upload crash dumps, or an archive of them, to a configured destination.
+// The upload runs in the background; its progress is shown in the state.
+func (r *RPC) UploadCrashDumps(in rpc.UploadInput) (*rpc.UploadOut, error) {
+	_, crashdumps := kdump.GetCrashFiles()
+	sel, err := selectedDumps(in.Index, in.ID, crashdumps)
+	if err != nil {
+		return nil, fmt.Errorf("UploadCrashDumps: %s", err)
+	}
+	var config []byte
+	if in.Bundle {
+		config = r.configJSON("UploadCrashDumps")
+	}
+	job, err := kdump.UploadCrashDumps(in.Destination, sel, in.Bundle, in.Compression, config)
+	if err != nil {
+		return nil, fmt.Errorf("UploadCrashDumps: %s", err)
+	}
+	return &rpc.UploadOut{UploadID: job.ID}, nil
+}
+
+// Cancel an upload of the upload queue
+func (r *RPC) CancelQueuedUpload(in rpc.QueueItemInput) (struct{}, error) {
+	if err := kdump.CancelQueuedUpload(in.ID); err != nil {
+		return struct{}{}, fmt.Errorf("CancelQueuedUpload: %s", err)
+	}
+	return struct{}{}, nil
+}
+
+// Retry an upload of the upload queue now
+func (r *RPC) RetryQueuedUpload(in rpc.QueueItemInput) (struct{}, error) {
+	if err := kdump.RetryQueuedUpload(in.ID); err != nil {
+		return struct{}{}, fmt.Errorf("RetryQueuedUpload: %s", err)
+	}
+	return struct{}{}, nil
+}
+
+// Position of a single crash dump selected by index or by ID
+func selectDump(index *int32, id string, crashdumps []os.FileInfo) (int, error) {
+	if id != "" {
+		n := dumpByID(id, crashdumps)
+		if n < 0 {
+			return -1, fmt.Errorf("Error: unknown crash dump %s", id)
+		}
+		return n, nil
+	}
+	if index == nil {
+		return -1, fmt.Errorf("Error: crash dump index or id is required")
+	}
+	return dumpIndex(*index, len(crashdumps))
+}
+
+// Indexes of the crash dumps selected by index and by ID, each crash dump
+// once. All crash dumps are selected if neither is given. Unknown IDs are
+// an error, while bad indexes are left for the caller to skip.
+func dumpSelection(index []int32, ids []string, crashdumps []os.FileInfo) ([]int32, error) {
+	if len(index) == 0 && len(ids) == 0 {
+		all := make([]int32, len(crashdumps))
+		for i := range crashdumps {
+			all[i] = int32(i)
+		}
+		return all, nil
+	}
+	sel := make([]int32, 0, len(index)+len(ids))
+	seen := make(map[int]bool)
+	add := func(n int32) {
+		// An index, its negative form and an id may select the same crash dump
+		key := int(n)
+		if r, err := dumpIndex(n, len(crashdumps)); err == nil {
+			key = r
+		}
+		if !seen[key] {
+			seen[key] = true
+			sel = append(sel, n)
+		}
+	}
+	for _, n := range index {
+		add(n)
+	}
+	bad_id := make([]string, 0)
+	for _, id := range ids {
+		n := dumpByID(id, crashdumps)
+		if n < 0 {
+			bad_id = append(bad_id, id)
+			continue
+		}
+		add(int32(n))
+	}
+	if len(bad_id) != 0 {
+		return nil, fmt.Errorf("unknown crash dump: %v", bad_id)
+	}
+	return sel, nil
+}
+
+// Position of a crash dump given its ID, the name of its crash directory.
+// Returns -1 for an unknown ID.
+func dumpByID(id string, crashdumps []os.FileInfo) int {
+	for i, cd := range crashdumps {
+		if cd.Name() == id {
+			return i
+		}
+	}
+	return -1
+}
+
 // This can take negative index
 func dumpIndex(n int32, ndumps int) (int, error) {
 	if int(n) >= ndumps || int(-n) > ndumps {
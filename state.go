@@ -7,7 +7,9 @@ import (
 	"fmt"
 	cf "github.com/danos/vyatta-kdump/internal/config"
 	"github.com/danos/vyatta-kdump/internal/kdump"
+	"github.com/danos/vyatta-kdump/internal/log"
 	st "github.com/danos/vyatta-kdump/internal/state"
+	"time"
 )
 
 type State struct {
@@ -60,12 +62,72 @@ func (s *State) isLastBootCrashed() bool {
 	return false
 }
 
-func dateTimeFromName(s string) string {
-	if len(s) != 12 {
+// Use the crash time from the dump if available. Otherwise fall back to
+// the crash directory name, which is in local time.
+func dateTimeFromName(s string, crashtime int64) string {
+	if crashtime != 0 {
+		return time.Unix(crashtime, 0).UTC().Format(time.RFC3339)
+	}
+	t, err := time.ParseInLocation("200601021504", s, time.Local)
+	if err != nil {
 		return ""
 	}
-	return fmt.Sprintf("%s-%s-%sT%s:%s:00Z",
-		s[:4], s[4:6], s[6:8], s[8:10], s[10:])
+	return t.Format(time.RFC3339)
+}
+
+func setVMCoreInfo(cd *st.CrashDumpData, name string) {
+	vmi, err := kdump.GetVMCoreInfo(name)
+	if err != nil {
+		log.Dlog.Printf("VMCOREINFO %s: %s", name, err)
+		cd.Timestamp = dateTimeFromName(name, 0)
+		return
+	}
+	cd.Timestamp = dateTimeFromName(name, vmi.CrashTime)
+	cd.KernelRelease = vmi.KernelRelease
+	cd.BuildID = vmi.BuildID
+	cd.PageSize = uint32(vmi.PageSize)
+	if vmi.CrashTime != 0 {
+		cd.CrashTime = cd.Timestamp
+	}
+	cd.PanicCPU = optUint32(vmi.PanicCPU)
+	cd.Symbols = kdump.SymbolsAvailable(vmi)
+}
+
+func optUint32(n int) *uint32 {
+	if n < 0 {
+		return nil
+	}
+	v := uint32(n)
+	return &v
+}
+
+func analysisData(a *kdump.CrashAnalysis) *st.CrashAnalysisData {
+	if a == nil {
+		return nil
+	}
+	return &st.CrashAnalysisData{
+		PanicMessage:       a.PanicMessage,
+		OopsType:           a.OopsType,
+		InstructionPointer: a.IP,
+		Task:               a.Task,
+		PID:                optUint32(a.PID),
+		CPU:                optUint32(a.CPU),
+		CallTrace:          a.CallTrace,
+		Tainted:            a.Tainted,
+		TaintFlags:         a.TaintFlags,
+		HardwareErrors:     a.HardwareHints,
+	}
+}
+
+func knownIssueData(ki *kdump.KnownIssue) *st.KnownIssueData {
+	if ki == nil {
+		return nil
+	}
+	return &st.KnownIssueData{
+		BugID:  ki.BugID,
+		Title:  ki.Title,
+		Advice: ki.Advice,
+	}
 }
 
 func getCrashDumps() []st.CrashDumpData {
@@ -76,11 +138,146 @@ func getCrashDumps() []st.CrashDumpData {
 	res := make([]st.CrashDumpData, len(files))
 
 	for i, entry := range files {
-		sz, _ := kdump.GetCrashSize(entry.Name())
+		sz, _ := kdump.CrashDumpSize(entry.Name())
 		res[i].Index = uint32(i)
-		res[i].Timestamp = dateTimeFromName(entry.Name())
+		res[i].ID = entry.Name()
 		res[i].Size = uint64(sz)
 		res[i].Path = fmt.Sprintf("%s/%s", crash_dir, entry.Name())
+		setVMCoreInfo(&res[i], entry.Name())
+		res[i].Signature = kdump.GetCrashSignature(entry)
+		res[i].Encrypted = kdump.IsEncrypted(entry.Name())
+		res[i].IncompleteReason = kdump.IncompleteReason(entry.Name())
+		res[i].Incomplete = res[i].IncompleteReason != ""
+		res[i].Integrity, res[i].VerifiedTime = kdump.GetCrashIntegrity(entry)
+		if meta, err := kdump.ReadDumpMeta(entry.Name()); err == nil {
+			res[i].Pinned = meta.Pinned
+			res[i].Notes = meta.Notes
+			if meta.Imported != nil {
+				res[i].ImportedFrom = meta.Imported.Path
+			}
+		}
+		res[i].Analysis = analysisData(kdump.GetCrashAnalysis(entry))
+		res[i].KnownIssue = knownIssueData(kdump.MatchKnownIssue(entry))
+	}
+	return res
+}
+
+func getSecureDeletes() []st.SecureDelete {
+	wipes := kdump.GetSecureDeletes()
+	if len(wipes) == 0 {
+		return nil
+	}
+	res := make([]st.SecureDelete, len(wipes))
+	for i, w := range wipes {
+		res[i] = st.SecureDelete{
+			Name:      w.Name,
+			Total:     uint64(w.Total),
+			Wiped:     uint64(w.Done),
+			Percent:   100,
+			StartTime: w.Started.Format(time.RFC3339),
+		}
+		if w.Total != 0 {
+			res[i].Percent = uint8(w.Done * 100 / w.Total)
+		}
+	}
+	return res
+}
+
+func getOrphanedEntries() []st.OrphanedEntry {
+	orphans := kdump.GetOrphanedEntries()
+	if len(orphans) == 0 {
+		return nil
+	}
+	res := make([]st.OrphanedEntry, len(orphans))
+	for i, o := range orphans {
+		res[i] = st.OrphanedEntry{
+			Path:   o.Path,
+			Size:   uint64(o.Size),
+			Reason: o.Reason,
+			Kept:   o.Kept,
+		}
+	}
+	return res
+}
+
+func getExports() []st.Export {
+	exports := kdump.GetExports()
+	if len(exports) == 0 {
+		return nil
+	}
+	res := make([]st.Export, len(exports))
+	for i, e := range exports {
+		res[i] = st.Export{
+			Archive:   e.Archive,
+			Total:     uint64(e.Total),
+			Written:   uint64(e.Done),
+			Percent:   100,
+			StartTime: e.Started.Format(time.RFC3339),
+			Status:    e.Status,
+			Error:     e.Error,
+		}
+		if e.Total != 0 && e.Done < e.Total {
+			res[i].Percent = uint8(e.Done * 100 / e.Total)
+		}
+	}
+	return res
+}
+
+func getUploads() []st.Upload {
+	uploads := kdump.GetUploads()
+	if len(uploads) == 0 {
+		return nil
+	}
+	res := make([]st.Upload, len(uploads))
+	for i, u := range uploads {
+		res[i] = st.Upload{
+			ID:          u.ID,
+			Destination: u.Destination,
+			CrashDumps:  u.CrashDumps,
+			Bundle:      u.Bundle,
+			StartTime:   u.Started.Format(time.RFC3339),
+			Status:      u.Status,
+			Error:       u.Error,
+		}
+		for _, f := range u.Files {
+			res[i].Files = append(res[i].Files, st.UploadFile{
+				Remote:   f.Remote,
+				Size:     uint64(f.Size),
+				SHA256:   f.SHA256,
+				Status:   f.Status,
+				Resumed:  f.Resumed,
+				Verified: f.Verified,
+				Error:    f.Error,
+			})
+		}
+	}
+	return res
+}
+
+func getUploadQueue() []st.QueueItem {
+	items := kdump.GetUploadQueue()
+	if len(items) == 0 {
+		return nil
+	}
+	res := make([]st.QueueItem, len(items))
+	for i, q := range items {
+		res[i] = st.QueueItem{
+			ID:          q.ID,
+			CrashDump:   q.CrashDump,
+			Destination: q.Destination,
+			Content:     q.Content,
+			Status:      q.Status,
+			Attempts:    uint32(q.Attempts),
+			AddTime:     q.Added.Format(time.RFC3339),
+			Error:       q.Error,
+			UploadID:    q.UploadID,
+		}
+		if !q.LastAttempt.IsZero() {
+			res[i].LastAttempt = q.LastAttempt.Format(time.RFC3339)
+		}
+		if q.Status == kdump.UploadQueued && !q.NextAttempt.IsZero() {
+			res[i].NextAttempt = q.NextAttempt.Format(time.RFC3339)
+		}
 	}
 	return res
 }
@@ -92,6 +289,11 @@ func (s *State) getKDumpStatus() *st.KDumpStatusData {
 		NeedReboot:        kdump.IsRebootNeeded(),
 		CrashRebootStatus: s.isLastBootCrashed(),
 		CrashDumps:        getCrashDumps(),
+		SecureDeletes:     getSecureDeletes(),
+		OrphanedEntries:   getOrphanedEntries(),
+		Exports:           getExports(),
+		Uploads:           getUploads(),
+		UploadQueue:       getUploadQueue(),
 	}
 }
 